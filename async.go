@@ -0,0 +1,65 @@
+// Copyright (c), Ruslan Sendecky. All rights reserved
+// Use of this source code is governed by the MIT license
+// See the LICENSE file in the project root for more information
+
+package gsession
+
+import (
+	"context"
+	"time"
+)
+
+// Pending asynchronous activity timestamp write
+type touchop struct {
+	id string
+	tm time.Time
+}
+
+// Async touch queue length
+const asyncQueue = 1024
+
+// Queued validates session record and queues activity timestamp write on pass
+// Falls back to a synchronous write when the queue is full or closed by Shutdown
+func (m *Manager) queued(ctx context.Context, id string) (sesval, *Session, error) {
+	val, ses, err := m.validate(ctx, id)
+	if err != nil || val != sesPass {
+		return val, ses, err
+	}
+	op := touchop{id: id, tm: m.now()}
+	m.wmu.RLock()
+	if m.closed {
+		m.wmu.RUnlock()
+		m.write(op)
+		return val, ses, nil
+	}
+	select {
+	case m.writes <- op:
+		m.wmu.RUnlock()
+	default:
+		m.wmu.RUnlock()
+		m.log("debug", "async write queue full")
+		m.write(op)
+	}
+	return val, ses, nil
+}
+
+// Drain runs queued activity timestamp writes until the queue is closed
+func (m *Manager) drain(ops chan touchop) {
+	defer close(m.drained)
+	for op := range ops {
+		m.write(op)
+	}
+}
+
+// Write stores activity timestamp unless the record holds a later one
+// Records removed in the meantime are skipped
+func (m *Manager) write(op touchop) {
+	err := m.update(context.Background(), op.id, func(ses *Session) {
+		if op.tm.After(ses.Tstamp) {
+			ses.Tstamp = op.tm
+		}
+	})
+	if err != nil && err != ErrSessionNoRecord {
+		m.log("error", "async touch write failed", "err", err)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright (c), Ruslan Sendecky. All rights reserved
+// Use of this source code is governed by the MIT license
+// See the LICENSE file in the project root for more information
+
+package gsession
+
+import (
+	"net"
+	"net/http"
+)
+
+// Binding selects client fingerprint parts a session is bound to
+type Binding int
+
+// Client binding constants
+const (
+	BindIP Binding = 1 << iota
+	BindUserAgent
+	BindBoth = BindIP | BindUserAgent
+)
+
+// Bound reports whether request fingerprint matches client metadata captured on create
+func (m *Manager) bound(ses *Session, r *http.Request) bool {
+	if m.bind&BindIP != 0 {
+		addr, ok := ses.Meta[MetaRemoteAddr]
+		if !ok || clientIP(addr) != clientIP(r.RemoteAddr) {
+			return false
+		}
+	}
+	if m.bind&BindUserAgent != 0 {
+		ua, ok := ses.Meta[MetaUserAgent]
+		if !ok || ua != r.UserAgent() {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns host part of network address
+func clientIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
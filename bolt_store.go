@@ -0,0 +1,251 @@
+// Copyright (c), Ruslan Sendecky. All rights reserved
+// Use of this source code is governed by the MIT license
+// See the LICENSE file in the project root for more information
+
+package gsession
+
+import (
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStore struct
+type BoltStore struct {
+	shelf  *bolt.DB
+	bucket []byte
+	codec  Codec
+	log    Logger
+}
+
+// NewBoltStore creates a new bolt store
+// Takes database file path, bucket name and optional store options
+// Empty path defaults to "session.db", empty bucket defaults to "gsession"
+func NewBoltStore(path, bucket string, opts ...StoreOption) (*BoltStore, error) {
+	cfg := newStoreConfig(opts)
+	if path == "" {
+		path = "session.db"
+	}
+	if bucket == "" {
+		bucket = "gsession"
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second * 5})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	store := &BoltStore{
+		shelf:  db,
+		bucket: []byte(bucket),
+		codec:  cfg.codec,
+		log:    cfg.log,
+	}
+
+	return store, nil
+}
+
+// Close closes the database
+func (s *BoltStore) Close() error {
+	return s.shelf.Close()
+}
+
+// Create adds a new session entry to the store
+// Takes a session ID and Session struct or nil
+// Pass nil to create default session
+// Psss Session pointer to create an entry with pre defined data or overwrite existing
+func (s *BoltStore) Create(id string, ses *Session) (err error) {
+	if id == "" {
+		return ErrEmptyID
+	}
+	if ses == nil {
+		ses = &Session{
+			Origin: time.Now(),
+			Tstamp: time.Now(),
+			Token:  "",
+			Data:   make(map[string]interface{}),
+		}
+	} else {
+		if ses.Origin.IsZero() {
+			ses.Origin = time.Now()
+		}
+		if ses.Tstamp.IsZero() {
+			ses.Tstamp = time.Now()
+		}
+		if ses.Data == nil {
+			ses.Data = make(map[string]interface{})
+		}
+	}
+	err = s.shelf.Update(func(tx *bolt.Tx) error {
+		bts, err := s.codec.Encode(ses)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(s.bucket).Put([]byte(id), bts)
+	})
+	return
+}
+
+// Read retrieves Session from store
+// Takes session ID
+// If session not found returns ErrSessionNoRecord error
+func (s *BoltStore) Read(id string) (ses *Session, err error) {
+	if id == "" {
+		return nil, ErrEmptyID
+	}
+	err = s.shelf.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(s.bucket).Get([]byte(id))
+		if val == nil {
+			return ErrSessionNoRecord
+		}
+		ses = new(Session)
+		return s.codec.Decode(val, ses)
+	})
+	if err != nil {
+		ses = nil
+	}
+	return
+}
+
+// Update runs a function on Session
+// Takes session ID and a function with Session as parameter
+// If session not found returns ErrSessionNoRecord error
+func (s *BoltStore) Update(id string, run func(*Session)) (err error) {
+	if id == "" {
+		return ErrEmptyID
+	}
+	err = s.shelf.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(s.bucket)
+		val := bkt.Get([]byte(id))
+		if val == nil {
+			return ErrSessionNoRecord
+		}
+		ses := new(Session)
+		if err := s.codec.Decode(val, ses); err != nil {
+			return err
+		}
+		run(ses)
+		bts, err := s.codec.Encode(ses)
+		if err != nil {
+			return err
+		}
+		return bkt.Put([]byte(id), bts)
+	})
+	return
+}
+
+// Delete removes Session from the store
+// Takes session ID
+func (s *BoltStore) Delete(id string) (err error) {
+	if id == "" {
+		return ErrEmptyID
+	}
+	err = s.shelf.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Delete([]byte(id))
+	})
+	return
+}
+
+// Ping checks the database is open and the bucket exists
+func (s *BoltStore) Ping() error {
+	return s.shelf.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(s.bucket) == nil {
+			return bolt.ErrBucketNotFound
+		}
+		return nil
+	})
+}
+
+// Expire removes expired records
+// Takes expiration duration
+func (s *BoltStore) Expire(exp time.Duration) (err error) {
+	return s.ExpireFunc(exp, nil)
+}
+
+// ExpireFunc removes expired records calling a function before each deletion
+// Takes expiration duration and a function with session ID and Session as parameters or nil
+// Function runs inside store transaction and must not call back into the store
+func (s *BoltStore) ExpireFunc(exp time.Duration, fn func(string, *Session)) (err error) {
+	return s.sweep(func(_ string, ses *Session) bool {
+		return time.Now().After(ses.Origin.Add(exp))
+	}, fn)
+}
+
+// ExpireIdle removes records inactive for longer than idle duration
+// Records with own idle timeout use it instead, negative timeout keeps the record
+// Takes idle duration
+func (s *BoltStore) ExpireIdle(idle time.Duration) error {
+	return s.sweep(func(_ string, ses *Session) bool {
+		return ses.idled(idle, time.Now())
+	}, nil)
+}
+
+// Sweep removes records for which stale function of session ID and Session reports true
+// Function runs inside store transaction and must not call back into the store
+func (s *BoltStore) Sweep(stale func(string, *Session) bool) error {
+	return s.sweep(stale, nil)
+}
+
+// Sweep removes records matching stale function calling fn before each deletion
+func (s *BoltStore) sweep(stale func(string, *Session) bool, fn func(string, *Session)) (err error) {
+	err = s.shelf.Update(func(tx *bolt.Tx) error {
+		cur := tx.Bucket(s.bucket).Cursor()
+		for key, val := cur.First(); key != nil; {
+			ses := new(Session)
+			err := s.codec.Decode(val, ses)
+			if err == ErrCodecVersion {
+				// Records of newer format versions are left in place
+				key, val = cur.Next()
+				continue
+			}
+			if err != nil {
+				// Undecodable records are skipped so one bad value does not stop the sweep
+				s.log("error", "session record decode failed", "err", err)
+				key, val = cur.Next()
+				continue
+			}
+			if stale(string(key), ses) {
+				if fn != nil {
+					fn(string(key), ses)
+				}
+				if err := cur.Delete(); err != nil {
+					return err
+				}
+				key, val = cur.Seek(key)
+				continue
+			}
+			key, val = cur.Next()
+		}
+		return nil
+	})
+	return
+}
+
+// Count returns number of session records
+func (s *BoltStore) Count() (num int, err error) {
+	err = s.shelf.View(func(tx *bolt.Tx) error {
+		num = tx.Bucket(s.bucket).Stats().KeyN
+		return nil
+	})
+	return
+}
+
+// List returns IDs of all session records
+func (s *BoltStore) List() (ids []string, err error) {
+	err = s.shelf.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).ForEach(func(key, _ []byte) error {
+			ids = append(ids, string(key))
+			return nil
+		})
+	})
+	return
+}
@@ -0,0 +1,78 @@
+// Copyright (c), Ruslan Sendecky. All rights reserved
+// Use of this source code is governed by the MIT license
+// See the LICENSE file in the project root for more information
+
+package gsession
+
+import (
+	"context"
+	"time"
+)
+
+// Touch buffer coalesces session activity timestamps in memory
+// Buffered timestamps are flushed to the store every interval
+type touchBuffer struct {
+	tstamps map[string]time.Time
+	done    chan struct{}
+}
+
+// Buffered validates session record consulting buffered activity timestamp
+// On pass the activity is buffered instead of written to the store when mark is set
+func (m *Manager) buffered(ctx context.Context, id string, mark bool) (sesval, *Session, error) {
+	val, ses, err := m.validate(ctx, id)
+	if err != nil || ses == nil {
+		return val, ses, err
+	}
+	m.tmu.Lock()
+	defer m.tmu.Unlock()
+	if tm, ok := m.touches.tstamps[id]; ok {
+		if tm.After(ses.Tstamp) {
+			ses.Tstamp = tm
+		}
+		val = m.check(ses)
+	}
+	if val == sesPass {
+		if mark && m.closed {
+			return val, ses, m.update(ctx, id, func(ses *Session) { ses.Tstamp = m.now() })
+		}
+		if mark {
+			m.touches.tstamps[id] = m.now()
+		}
+	} else {
+		delete(m.touches.tstamps, id)
+	}
+	return val, ses, nil
+}
+
+// Flush writes buffered activity timestamps to the store
+// Records removed in the meantime are skipped
+func (m *Manager) flush() {
+	m.tmu.Lock()
+	tss := m.touches.tstamps
+	m.touches.tstamps = make(map[string]time.Time, len(tss))
+	m.tmu.Unlock()
+	for id, tm := range tss {
+		err := m.update(context.Background(), id, func(ses *Session) {
+			if tm.After(ses.Tstamp) {
+				ses.Tstamp = tm
+			}
+		})
+		if err != nil && err != ErrSessionNoRecord {
+			m.log("error", "buffered touch flush failed", "err", err)
+		}
+	}
+}
+
+// Runs buffered timestamps flush every interval until done is closed
+func (m *Manager) flusher(d time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.flush()
+		case <-done:
+			return
+		}
+	}
+}
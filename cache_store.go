@@ -0,0 +1,149 @@
+// Copyright (c), Ruslan Sendecky. All rights reserved
+// Use of this source code is governed by the MIT license
+// See the LICENSE file in the project root for more information
+
+package gsession
+
+import "time"
+
+// CacheStore fronts a durable backend store with a cache store
+// Backend is authoritative, cache holds copies of records read or written through this store
+// Records changed in the backend by other processes are served from cache until deleted or expired
+type CacheStore struct {
+	cache   Store
+	backend Store
+}
+
+// NewCacheStore creates a new tiered store
+// Takes cache store, typically a MemoryStore, and durable backend store
+func NewCacheStore(cache, backend Store) *CacheStore {
+	return &CacheStore{
+		cache:   cache,
+		backend: backend,
+	}
+}
+
+// Create adds a new session entry to the backend, then to the cache
+// Takes a session ID and Session struct or nil
+func (s *CacheStore) Create(id string, ses *Session) error {
+	if ses == nil {
+		now := time.Now()
+		ses = &Session{Origin: now, Tstamp: now, Data: make(map[string]interface{})}
+	}
+	err := s.backend.Create(id, ses)
+	if err != nil {
+		s.cache.Delete(id)
+		return err
+	}
+	return s.cache.Create(id, ses.copy())
+}
+
+// Read retrieves Session from the cache, then from the backend populating the cache
+// Takes session ID
+// If session not found returns ErrSessionNoRecord error
+func (s *CacheStore) Read(id string) (*Session, error) {
+	ses, err := s.cache.Read(id)
+	if err == nil {
+		return ses, nil
+	}
+	ses, err = s.backend.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	err = s.cache.Create(id, ses.copy())
+	if err != nil {
+		return nil, err
+	}
+	return ses, nil
+}
+
+// Update runs a function on Session in the backend and refreshes the cached copy
+// Cached copy is dropped when the backend update fails
+// Records no longer cached, such as deleted meanwhile, are not written back to the cache
+// Takes session ID and a function with Session as parameter
+// If session not found returns ErrSessionNoRecord error
+func (s *CacheStore) Update(id string, fn func(*Session)) error {
+	var res *Session
+	err := s.backend.Update(id, func(ses *Session) {
+		fn(ses)
+		res = ses.copy()
+	})
+	if err != nil {
+		s.cache.Delete(id)
+		return err
+	}
+	err = s.cache.Update(id, func(ses *Session) {
+		*ses = *res.copy()
+	})
+	if err == ErrSessionNoRecord {
+		return nil
+	}
+	return err
+}
+
+// Delete removes Session from both tiers
+// Takes session ID
+func (s *CacheStore) Delete(id string) error {
+	err := s.backend.Delete(id)
+	if err != nil {
+		return err
+	}
+	return s.cache.Delete(id)
+}
+
+// Ping checks both tiers
+func (s *CacheStore) Ping() error {
+	err := s.backend.Ping()
+	if err != nil {
+		return err
+	}
+	return s.cache.Ping()
+}
+
+// Expire removes expired records from both tiers
+// Takes expiration duration
+func (s *CacheStore) Expire(exp time.Duration) error {
+	err := s.backend.Expire(exp)
+	if err != nil {
+		return err
+	}
+	return s.cache.Expire(exp)
+}
+
+// Sweep removes records selected by stale function from both tiers
+// Returns ErrStoreUnsupported if either tier is not a Sweeper
+func (s *CacheStore) Sweep(stale func(string, *Session) bool) error {
+	bsw, ok := s.backend.(Sweeper)
+	if !ok {
+		return ErrStoreUnsupported
+	}
+	csw, ok := s.cache.(Sweeper)
+	if !ok {
+		return ErrStoreUnsupported
+	}
+	err := bsw.Sweep(stale)
+	if err != nil {
+		return err
+	}
+	return csw.Sweep(stale)
+}
+
+// Count returns number of backend session records
+// Returns ErrStoreUnsupported if backend is not a Counter
+func (s *CacheStore) Count() (int, error) {
+	cnt, ok := s.backend.(Counter)
+	if !ok {
+		return 0, ErrStoreUnsupported
+	}
+	return cnt.Count()
+}
+
+// List returns IDs of all backend session records
+// Returns ErrStoreUnsupported if backend is not a Lister
+func (s *CacheStore) List() ([]string, error) {
+	lst, ok := s.backend.(Lister)
+	if !ok {
+		return nil, ErrStoreUnsupported
+	}
+	return lst.List()
+}
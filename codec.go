@@ -0,0 +1,121 @@
+// Copyright (c), Ruslan Sendecky. All rights reserved
+// Use of this source code is governed by the MIT license
+// See the LICENSE file in the project root for more information
+
+package gsession
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// Codec serializes session records for persistent stores
+type Codec interface {
+	Encode(*Session) ([]byte, error)
+	Decode([]byte, *Session) error
+}
+
+// CodecError wraps serialization failures of built-in codecs
+// Custom codecs may return it so wrapping stores tell bad records from storage failures
+type CodecError struct {
+	Err error
+}
+
+// Error returns message of the wrapped error
+func (e *CodecError) Error() string {
+	return "session codec: " + e.Err.Error()
+}
+
+// Unwrap returns the wrapped error
+func (e *CodecError) Unwrap() error {
+	return e.Err
+}
+
+// Wraps non nil error into CodecError
+func codecErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &CodecError{Err: err}
+}
+
+// Gob record format version written as the first byte
+// Values 0x80 to 0xf7 never start a gob stream so unversioned records are told apart
+const gobVersion byte = 0x81
+
+// GobCodec encodes sessions with encoding/gob
+// Records are prefixed with a format version byte, records of unknown version return ErrCodecVersion
+// Custom data types must be registered with gob.Register
+type GobCodec struct{}
+
+// Encode serializes session with gob
+func (GobCodec) Encode(ses *Session) ([]byte, error) {
+	bts, err := encGob(ses)
+	if err != nil {
+		return nil, codecErr(err)
+	}
+	return append([]byte{gobVersion}, bts...), nil
+}
+
+// Decode deserializes gob encoded session
+// Records written before versioning are decoded as is
+func (GobCodec) Decode(bts []byte, ses *Session) error {
+	if len(bts) == 0 || bts[0] < 0x80 || bts[0] > 0xf7 {
+		return codecErr(decGob(bts, ses))
+	}
+	if bts[0] != gobVersion {
+		return ErrCodecVersion
+	}
+	return codecErr(decGob(bts[1:], ses))
+}
+
+// JSONCodec encodes sessions with encoding/json
+// Numbers in session data are restored as int when integral, float64 otherwise
+// Session fields are written with lower case names, e.g. origin, tstamp, token, data
+type JSONCodec struct{}
+
+// Encode serializes session with JSON
+func (JSONCodec) Encode(ses *Session) ([]byte, error) {
+	bts, err := json.Marshal(ses)
+	if err != nil {
+		return nil, codecErr(err)
+	}
+	return bts, nil
+}
+
+// Decode deserializes JSON encoded session
+func (JSONCodec) Decode(bts []byte, ses *Session) error {
+	dec := json.NewDecoder(bytes.NewReader(bts))
+	dec.UseNumber()
+	err := dec.Decode(ses)
+	if err != nil {
+		return codecErr(err)
+	}
+	for k, v := range ses.Data {
+		ses.Data[k] = jsonNumbers(v)
+	}
+	return nil
+}
+
+// Encode types to bytes
+func encGob(val interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	err := enc.Encode(val)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode types from bytes
+func decGob(bts []byte, res interface{}) error {
+	buf := bytes.NewBuffer(bts)
+	dec := gob.NewDecoder(buf)
+	err := dec.Decode(res)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright (c), Ruslan Sendecky. All rights reserved
+// Use of this source code is governed by the MIT license
+// See the LICENSE file in the project root for more information
+
+package gsession
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+)
+
+// Reserved session data key holding CSRF token
+const csrfKey = ReservedPrefix + "csrf"
+
+// CSRFToken returns CSRF token of the session
+// Token is generated and stored on first call and rotated by Regenerate
+// Takes HTTP request
+func (m *Manager) CSRFToken(r *http.Request) (string, error) {
+	ses, err := m.session(r.Context())
+	if err != nil {
+		return "", err
+	}
+	if tok, ok := ses.Data[csrfKey].(string); ok && tok != "" {
+		return tok, nil
+	}
+	tok := csrfToken()
+	err = m.modify(r.Context(), func(ses *Session) error {
+		if cur, ok := ses.Data[csrfKey].(string); ok && cur != "" {
+			tok = cur
+			return nil
+		}
+		ses.Data[csrfKey] = tok
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return tok, nil
+}
+
+// CSRFValidate reports whether token matches CSRF token of the session
+// Comparison runs in constant time. Missing session or token never matches
+// Takes HTTP request and submitted token
+func (m *Manager) CSRFValidate(r *http.Request, token string) bool {
+	ses, err := m.session(r.Context())
+	if err != nil {
+		return false
+	}
+	tok, ok := ses.Data[csrfKey].(string)
+	if !ok || tok == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(tok), []byte(token)) == 1
+}
+
+// Returns new random CSRF token
+// Panics if random source fails
+func csrfToken() string {
+	var bts [32]byte
+	_, err := rand.Read(bts[:])
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(bts[:])
+}
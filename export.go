@@ -0,0 +1,95 @@
+// Copyright (c), Ruslan Sendecky. All rights reserved
+// Use of this source code is governed by the MIT license
+// See the LICENSE file in the project root for more information
+
+package gsession
+
+import (
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"math"
+)
+
+func init() {
+	// Container types produced by JSON decoding of session data
+	gob.Register([]interface{}{})
+	gob.Register(map[string]interface{}{})
+}
+
+// Export returns session record as JSON including timestamps, token and data
+// Takes session ID
+func (m *Manager) Export(id string) ([]byte, error) {
+	ses, err := m.read(context.Background(), id)
+	if err != nil {
+		return nil, err
+	}
+	return JSONCodec{}.Encode(ses)
+}
+
+// Import creates session record from JSON produced by Export
+// Overwrites existing record with the same ID
+// JSON numbers are restored as int when integral, float64 otherwise
+// Takes session ID and JSON data
+func (m *Manager) Import(id string, data []byte) error {
+	ses := new(Session)
+	err := JSONCodec{}.Decode(data, ses)
+	if err != nil {
+		return err
+	}
+	return m.create(context.Background(), id, ses)
+}
+
+// Converts json.Number values to int or float64 recursively
+func jsonNumbers(val interface{}) interface{} {
+	switch v := val.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil && i >= math.MinInt && i <= math.MaxInt {
+			return int(i)
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = jsonNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonNumbers(e)
+		}
+	}
+	return val
+}
+
+// Dump returns copies of all session records keyed by session ID
+// Loads every record into memory, meant for debugging small stores behind protected endpoints
+// Store must implement Lister, otherwise ErrStoreUnsupported is returned
+func (m *Manager) Dump() (map[string]*Session, error) {
+	if m.store == nil {
+		return nil, ErrStoreUnavailable
+	}
+	lst, ok := m.store.(Lister)
+	if !ok {
+		return nil, ErrStoreUnsupported
+	}
+	keys, err := lst.List()
+	if err != nil {
+		return nil, err
+	}
+	dump := make(map[string]*Session, len(keys))
+	for _, key := range keys {
+		id, ok := m.unkey(key)
+		if !ok {
+			continue
+		}
+		ses, err := m.read(context.Background(), id)
+		if err != nil {
+			if err == ErrSessionNoRecord {
+				continue
+			}
+			return nil, err
+		}
+		dump[id] = ses.copy()
+	}
+	return dump, nil
+}
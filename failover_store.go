@@ -0,0 +1,206 @@
+// Copyright (c), Ruslan Sendecky. All rights reserved
+// Use of this source code is governed by the MIT license
+// See the LICENSE file in the project root for more information
+
+package gsession
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FailoverStore wraps a persistent store and degrades to memory when it fails to write
+// Invalid IDs and records the codec cannot handle are reported without degrading
+// Once degraded new writes go to memory, records still found only in the primary store stay readable
+// Degraded mode lasts for the life of the store
+type FailoverStore struct {
+	primary  Store
+	fallback *MemoryStore
+	log      Logger
+	mu       sync.RWMutex
+	degraded bool
+	gone     map[string]struct{}
+}
+
+// NewFailoverStore creates a new failover store
+// Takes primary store and optional store options, failures are reported to the store logger
+func NewFailoverStore(primary Store, opts ...StoreOption) *FailoverStore {
+	cfg := newStoreConfig(opts)
+	return &FailoverStore{
+		primary:  primary,
+		fallback: NewMemoryStore(),
+		log:      cfg.log,
+		gone:     make(map[string]struct{}),
+	}
+}
+
+// Degraded reports whether the store switched to memory fallback
+func (s *FailoverStore) Degraded() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.degraded
+}
+
+// Create adds a new session entry to the primary store or memory fallback
+// Takes a session ID and Session struct or nil
+func (s *FailoverStore) Create(id string, ses *Session) error {
+	if !s.Degraded() {
+		err := s.primary.Create(id, ses)
+		if !failure(err) {
+			return err
+		}
+		s.degrade(err)
+	}
+	s.mu.Lock()
+	delete(s.gone, id)
+	s.mu.Unlock()
+	return s.fallback.Create(id, ses)
+}
+
+// Read retrieves Session from memory fallback, then from primary store
+// Takes session ID
+// If session not found returns ErrSessionNoRecord error
+func (s *FailoverStore) Read(id string) (*Session, error) {
+	if !s.Degraded() {
+		return s.primary.Read(id)
+	}
+	ses, err := s.fallback.Read(id)
+	if err != ErrSessionNoRecord {
+		return ses, err
+	}
+	s.mu.RLock()
+	_, gone := s.gone[id]
+	s.mu.RUnlock()
+	if gone {
+		return nil, ErrSessionNoRecord
+	}
+	return s.primary.Read(id)
+}
+
+// Update runs a function on Session
+// Records still held by the primary store are copied to memory fallback when degraded
+// Takes session ID and a function with Session as parameter
+// If session not found returns ErrSessionNoRecord error
+func (s *FailoverStore) Update(id string, fn func(*Session)) error {
+	if !s.Degraded() {
+		err := s.primary.Update(id, fn)
+		if !failure(err) {
+			return err
+		}
+		s.degrade(err)
+	}
+	err := s.fallback.Update(id, fn)
+	if err != ErrSessionNoRecord {
+		return err
+	}
+	err = s.adopt(id)
+	if err != nil {
+		return err
+	}
+	return s.fallback.Update(id, fn)
+}
+
+// Delete removes Session from both stores
+// Records the primary store fails to delete are hidden from subsequent reads
+// Takes session ID
+func (s *FailoverStore) Delete(id string) error {
+	err := s.fallback.Delete(id)
+	if err != nil {
+		return err
+	}
+	err = s.primary.Delete(id)
+	if !failure(err) {
+		return err
+	}
+	s.degrade(err)
+	s.mu.Lock()
+	s.gone[id] = struct{}{}
+	s.mu.Unlock()
+	return nil
+}
+
+// Ping checks the fallback store, primary failures are tolerated while degraded
+func (s *FailoverStore) Ping() error {
+	err := s.fallback.Ping()
+	if err != nil {
+		return err
+	}
+	err = s.primary.Ping()
+	if err != nil && s.Degraded() {
+		return nil
+	}
+	return err
+}
+
+// Expire removes expired records from both stores
+// Takes expiration duration
+func (s *FailoverStore) Expire(exp time.Duration) error {
+	err := s.fallback.Expire(exp)
+	if err != nil {
+		return err
+	}
+	err = s.primary.Expire(exp)
+	if err != nil && s.Degraded() {
+		s.log("error", "failover primary expire failed", "err", err)
+		return nil
+	}
+	return err
+}
+
+// Sweep removes records selected by stale function from both stores
+// Returns ErrStoreUnsupported if primary store is not a Sweeper
+func (s *FailoverStore) Sweep(stale func(string, *Session) bool) error {
+	psw, ok := s.primary.(Sweeper)
+	if !ok {
+		return ErrStoreUnsupported
+	}
+	err := s.fallback.Sweep(stale)
+	if err != nil {
+		return err
+	}
+	err = psw.Sweep(stale)
+	if err != nil && s.Degraded() {
+		s.log("error", "failover primary sweep failed", "err", err)
+		return nil
+	}
+	return err
+}
+
+// Failure reports whether primary store error is a storage failure calling for fallback
+// Empty IDs, missing records and record serialization errors are passed through
+func failure(err error) bool {
+	if err == nil || err == ErrEmptyID || err == ErrSessionNoRecord || err == ErrCodecVersion {
+		return false
+	}
+	var cerr *CodecError
+	return !errors.As(err, &cerr)
+}
+
+// Degrade switches the store to memory fallback
+func (s *FailoverStore) degrade(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.degraded {
+		s.degraded = true
+		s.log("error", "primary store write failed, degrading to memory", "err", err)
+	}
+}
+
+// Adopt copies record held only by the primary store to memory fallback
+func (s *FailoverStore) adopt(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.fallback.Read(id); err == nil {
+		return nil
+	}
+	if _, gone := s.gone[id]; gone {
+		return ErrSessionNoRecord
+	}
+	ses, err := s.primary.Read(id)
+	if err != nil {
+		return err
+	}
+	return s.fallback.Create(id, ses)
+}
@@ -5,9 +5,9 @@
 package gsession
 
 import (
-	"bytes"
-	"encoding/gob"
 	"log"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/badger/v4"
@@ -15,13 +15,26 @@ import (
 
 // FileStore struct
 type FileStore struct {
-	shelf *badger.DB
+	shelf  *badger.DB
+	gc     sync.Mutex
+	log    Logger
+	codec  Codec
+	stop   chan struct{}
+	once   sync.Once
+	prefix []byte
 }
 
+// Maximum value log GC rewrites per vacuum cycle
+const gcRounds = 16
+
 // NewFileStore creates a new file store
-// Takes directory path for the database files
-// Empty directory string defaults to "session"
-func NewFileStore(dir string) *FileStore {
+// Takes directory path for the database files and optional store options
+// Empty directory string defaults to GSESSION_DIR environment variable, then to "session"
+func NewFileStore(dir string, opts ...StoreOption) *FileStore {
+	cfg := newStoreConfig(opts)
+	if dir == "" {
+		dir = os.Getenv("GSESSION_DIR")
+	}
 	if dir == "" {
 		dir = "session"
 	}
@@ -32,7 +45,11 @@ func NewFileStore(dir string) *FileStore {
 	}
 
 	store := &FileStore{
-		shelf: db,
+		shelf:  db,
+		log:    cfg.log,
+		codec:  cfg.codec,
+		stop:   make(chan struct{}),
+		prefix: []byte(cfg.prefix),
 	}
 
 	go store.vacuum(time.Hour * 12)
@@ -45,6 +62,9 @@ func NewFileStore(dir string) *FileStore {
 // Pass nil to create default session
 // Psss Session pointer to create an entry with pre defined data or overwrite existing
 func (s *FileStore) Create(id string, ses *Session) (err error) {
+	if id == "" {
+		return ErrEmptyID
+	}
 	if ses == nil {
 		ses = &Session{
 			Origin: time.Now(),
@@ -64,11 +84,11 @@ func (s *FileStore) Create(id string, ses *Session) (err error) {
 		}
 	}
 	err = s.shelf.Update(func(txn *badger.Txn) error {
-		bts, err := encGob(ses)
+		bts, err := s.codec.Encode(ses)
 		if err != nil {
 			return err
 		}
-		err = txn.Set([]byte(id), bts)
+		err = txn.Set(s.key(id), bts)
 		if err != nil {
 			return err
 		}
@@ -81,8 +101,11 @@ func (s *FileStore) Create(id string, ses *Session) (err error) {
 // Takes session ID
 // If session not found returns ErrSessionNoRecord error
 func (s *FileStore) Read(id string) (ses *Session, err error) {
+	if id == "" {
+		return nil, ErrEmptyID
+	}
 	err = s.shelf.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(id))
+		item, err := txn.Get(s.key(id))
 		if err != nil {
 			return err
 		}
@@ -91,13 +114,13 @@ func (s *FileStore) Read(id string) (ses *Session, err error) {
 			return err
 		}
 		ses = new(Session)
-		if err := decGob(val, ses); err != nil {
+		if err := s.codec.Decode(val, ses); err != nil {
 			return err
 		}
 		return nil
 	})
 	if err != nil {
-		if err == badger.ErrKeyNotFound || err == badger.ErrEmptyKey {
+		if err == badger.ErrKeyNotFound {
 			err = ErrSessionNoRecord
 		}
 	}
@@ -108,8 +131,11 @@ func (s *FileStore) Read(id string) (ses *Session, err error) {
 // Takes session ID and a function with Session as parameter
 // If session not found returns ErrSessionNoRecord error
 func (s *FileStore) Update(id string, run func(*Session)) (err error) {
+	if id == "" {
+		return ErrEmptyID
+	}
 	err = s.shelf.Update(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(id))
+		item, err := txn.Get(s.key(id))
 		if err != nil {
 			return err
 		}
@@ -118,28 +144,36 @@ func (s *FileStore) Update(id string, run func(*Session)) (err error) {
 			return err
 		}
 		ses := new(Session)
-		if err := decGob(val, ses); err != nil {
+		if err := s.codec.Decode(val, ses); err != nil {
 			return err
 		}
 		run(ses)
-		bts, err := encGob(ses)
+		bts, err := s.codec.Encode(ses)
 		if err != nil {
 			return err
 		}
-		err = txn.Set([]byte(id), bts)
+		err = txn.Set(s.key(id), bts)
 		if err != nil {
 			return err
 		}
 		return nil
 	})
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			err = ErrSessionNoRecord
+		}
+	}
 	return
 }
 
 // Delete removes Session from the store
 // Takes session ID
 func (s *FileStore) Delete(id string) (err error) {
+	if id == "" {
+		return ErrEmptyID
+	}
 	err = s.shelf.Update(func(txn *badger.Txn) error {
-		err := txn.Delete([]byte(id))
+		err := txn.Delete(s.key(id))
 		if err != nil {
 			return err
 		}
@@ -148,72 +182,174 @@ func (s *FileStore) Delete(id string) (err error) {
 	return
 }
 
+// Ping checks the database is open and readable
+func (s *FileStore) Ping() error {
+	if s.shelf.IsClosed() {
+		return badger.ErrDBClosed
+	}
+	return s.shelf.View(func(txn *badger.Txn) error {
+		return nil
+	})
+}
+
 // Expire removes expired records
 // Takes expiration duration
 func (s *FileStore) Expire(exp time.Duration) (err error) {
+	return s.ExpireFunc(exp, nil)
+}
+
+// ExpireFunc removes expired records calling a function before each deletion
+// Takes expiration duration and a function with session ID and Session as parameters or nil
+// Function runs inside store transaction and must not call back into the store
+func (s *FileStore) ExpireFunc(exp time.Duration, fn func(string, *Session)) (err error) {
+	return s.sweep(func(_ string, ses *Session) bool {
+		return time.Now().After(ses.Origin.Add(exp))
+	}, fn)
+}
+
+// ExpireIdle removes records inactive for longer than idle duration
+// Records with own idle timeout use it instead, negative timeout keeps the record
+// Takes idle duration
+func (s *FileStore) ExpireIdle(idle time.Duration) error {
+	return s.sweep(func(_ string, ses *Session) bool {
+		return ses.idled(idle, time.Now())
+	}, nil)
+}
+
+// Sweep removes records for which stale function of session ID and Session reports true
+// Function runs inside store transaction and must not call back into the store
+func (s *FileStore) Sweep(stale func(string, *Session) bool) error {
+	return s.sweep(stale, nil)
+}
+
+// Sweep removes records matching stale function calling fn before each deletion
+func (s *FileStore) sweep(stale func(string, *Session) bool, fn func(string, *Session)) (err error) {
+	s.gc.Lock()
+	defer s.gc.Unlock()
 	err = s.shelf.Update(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		for it.Rewind(); it.Valid(); it.Next() {
+		opt := badger.DefaultIteratorOptions
+		opt.Prefix = s.prefix
+		it := txn.NewIterator(opt)
+		defer it.Close()
+		for it.Rewind(); it.ValidForPrefix(s.prefix); it.Next() {
 			item := it.Item()
-			key := item.Key()
+			key := item.KeyCopy(nil)
 			val, err := item.ValueCopy(nil)
 			if err != nil {
 				return err
 			}
 			ses := new(Session)
-			if err := decGob(val, ses); err != nil {
-				return err
+			err = s.codec.Decode(val, ses)
+			if err == ErrCodecVersion {
+				// Records of newer format versions are left in place
+				continue
+			}
+			if err != nil {
+				// Undecodable records are skipped so one bad value does not stop the sweep
+				s.log("error", "session record decode failed", "err", err)
+				continue
 			}
-			if time.Now().After(ses.Origin.Add(exp)) {
+			id := string(key[len(s.prefix):])
+			if stale(id, ses) {
+				if fn != nil {
+					fn(id, ses)
+				}
 				err = txn.Delete(key)
 				if err != nil {
 					return err
 				}
 			}
 		}
-		it.Close()
 		return nil
 	})
 	return
 }
 
-// Encode types to bytes
-func encGob(val interface{}) ([]byte, error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(val)
-	if err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+// Count returns number of session records
+func (s *FileStore) Count() (num int, err error) {
+	err = s.shelf.View(func(txn *badger.Txn) error {
+		opt := badger.DefaultIteratorOptions
+		opt.PrefetchValues = false
+		opt.Prefix = s.prefix
+		it := txn.NewIterator(opt)
+		defer it.Close()
+		for it.Rewind(); it.ValidForPrefix(s.prefix); it.Next() {
+			num++
+		}
+		return nil
+	})
+	return
 }
 
-// Decode types from bytes
-func decGob(bts []byte, res interface{}) error {
-	buf := bytes.NewBuffer(bts)
-	dec := gob.NewDecoder(buf)
-	err := dec.Decode(res)
-	if err != nil {
-		return err
-	}
-	return nil
+// List returns IDs of all session records
+func (s *FileStore) List() (ids []string, err error) {
+	err = s.shelf.View(func(txn *badger.Txn) error {
+		opt := badger.DefaultIteratorOptions
+		opt.PrefetchValues = false
+		opt.Prefix = s.prefix
+		it := txn.NewIterator(opt)
+		defer it.Close()
+		for it.Rewind(); it.ValidForPrefix(s.prefix); it.Next() {
+			ids = append(ids, string(it.Item().Key()[len(s.prefix):]))
+		}
+		return nil
+	})
+	return
+}
+
+// Key returns database key of session ID
+func (s *FileStore) key(id string) []byte {
+	return append(append([]byte(nil), s.prefix...), id...)
 }
 
 // Vacuum runs GC every nth
 // Takes interval as duration
+// Stops when the store is closed
 func (s *FileStore) vacuum(d time.Duration) {
 	if d == 0 {
 		return
 	}
 	ticker := time.NewTicker(d)
-	run := func() {
-	repeat:
-		err := s.shelf.RunValueLogGC(0.5)
-		if err == nil {
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.collect()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Close stops value log GC and closes the database
+// Waits for running expiry or GC to finish
+func (s *FileStore) Close() (err error) {
+	s.once.Do(func() {
+		close(s.stop)
+		s.gc.Lock()
+		defer s.gc.Unlock()
+		err = s.shelf.Close()
+	})
+	return
+}
+
+// Collect runs value log GC until there is nothing left to rewrite
+// Bounded to gcRounds passes per cycle, GC failures are reported to the store logger
+// Serialised with Expire so cleanup and GC do not compete
+func (s *FileStore) collect() {
+	s.gc.Lock()
+	defer s.gc.Unlock()
+	num := 0
+repeat:
+	err := s.shelf.RunValueLogGC(0.5)
+	if err == nil {
+		num++
+		if num < gcRounds {
 			goto repeat
 		}
 	}
-	for range ticker.C {
-		run()
+	if err != nil && err != badger.ErrNoRewrite {
+		s.log("error", "value log gc failed", "err", err)
 	}
+	s.log("debug", "value log gc cycle", "rewrites", num)
 }
@@ -0,0 +1,60 @@
+// Copyright (c), Ruslan Sendecky. All rights reserved
+// Use of this source code is governed by the MIT license
+// See the LICENSE file in the project root for more information
+
+package gsession
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+
+	"github.com/google/uuid"
+)
+
+// IDGenerator produces and validates session IDs
+// Valid must accept every ID produced by New, malformed cookie values never reach the store
+type IDGenerator interface {
+	New() string
+	Valid(string) bool
+}
+
+// UUIDGenerator produces 36 character random UUIDs. Default generator
+type UUIDGenerator struct{}
+
+// New returns random UUID string
+// Panics if random source fails
+func (UUIDGenerator) New() string {
+	return uuid.New().String()
+}
+
+// Valid checks session ID has canonical UUID format
+func (UUIDGenerator) Valid(id string) bool {
+	if len(id) != 36 {
+		return false
+	}
+	_, err := uuid.Parse(id)
+	return err == nil
+}
+
+// Base64IDGenerator produces 22 character base64url encoded 16 byte random IDs
+type Base64IDGenerator struct{}
+
+// New returns random base64url ID
+// Panics if random source fails
+func (Base64IDGenerator) New() string {
+	var bts [16]byte
+	_, err := rand.Read(bts[:])
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(bts[:])
+}
+
+// Valid checks session ID is base64url encoding of 16 bytes
+func (Base64IDGenerator) Valid(id string) bool {
+	if len(id) != 22 {
+		return false
+	}
+	bts, err := base64.RawURLEncoding.DecodeString(id)
+	return err == nil && len(bts) == 16
+}
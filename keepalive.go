@@ -0,0 +1,54 @@
+// Copyright (c), Ruslan Sendecky. All rights reserved
+// Use of this source code is governed by the MIT license
+// See the LICENSE file in the project root for more information
+
+package gsession
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// KeepAlive updates session activity timestamp every interval
+// Use it to keep sessions of long lived connections such as WebSockets from idling out
+// Absolute expiry still applies. Stops when the context is done, the record is gone or stop is called
+// Zero or negative interval defaults to half of the idle timeout
+// Takes context, session ID and touch interval
+func (m *Manager) KeepAlive(ctx context.Context, id string, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+	stop = func() {
+		once.Do(func() { close(done) })
+	}
+	if interval <= 0 {
+		interval = m.idle / 2
+	}
+	if interval <= 0 {
+		return stop
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := m.update(ctx, id, func(ses *Session) {
+					ses.Tstamp = m.now()
+				})
+				if err == ErrSessionNoRecord {
+					m.log("debug", "keep alive session gone")
+					return
+				}
+				if err != nil {
+					m.log("error", "keep alive touch failed", "err", err)
+				}
+			case <-ctx.Done():
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+	return stop
+}
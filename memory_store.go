@@ -5,6 +5,7 @@
 package gsession
 
 import (
+	"container/list"
 	"sync"
 	"time"
 )
@@ -13,13 +14,40 @@ import (
 type MemoryStore struct {
 	sync.RWMutex
 	shelf map[string]*Session
+	users map[string]map[string]struct{}
+	lru   *recency
+}
+
+// Recency tracks session access order of capacity bound memory store
+// Front of the list is the most recently used ID
+type recency struct {
+	cap   int
+	order *list.List
+	elems map[string]*list.Element
 }
 
 // NewMemoryStore creates a new memory store
 func NewMemoryStore() *MemoryStore {
 	return &MemoryStore{
 		shelf: make(map[string]*Session),
+		users: make(map[string]map[string]struct{}),
+	}
+}
+
+// NewMemoryStoreLRU creates a new memory store holding at most capacity sessions
+// Least recently read, updated or created session is evicted when full
+// Evicted sessions are treated as invalid on their next request
+// Zero or negative capacity leaves the store unbounded
+func NewMemoryStoreLRU(capacity int) *MemoryStore {
+	s := NewMemoryStore()
+	if capacity > 0 {
+		s.lru = &recency{
+			cap:   capacity,
+			order: list.New(),
+			elems: make(map[string]*list.Element),
+		}
 	}
+	return s
 }
 
 // Create adds a new session entry to the store
@@ -27,40 +55,55 @@ func NewMemoryStore() *MemoryStore {
 // Pass nil to create default session
 // Psss Session pointer to create an entry with pre defined data or overwrite existing
 func (s *MemoryStore) Create(id string, ses *Session) error {
-	defer s.Unlock()
+	if id == "" {
+		return ErrEmptyID
+	}
 	if ses == nil {
-		s.Lock()
-		s.shelf[id] = &Session{
+		ses = &Session{
 			Origin: time.Now(),
 			Tstamp: time.Now(),
 			Token:  "",
 			Data:   make(map[string]interface{}),
 		}
-		return nil
-	}
-	if ses.Origin.IsZero() {
-		ses.Origin = time.Now()
-	}
-	if ses.Tstamp.IsZero() {
-		ses.Tstamp = time.Now()
-	}
-	if ses.Data == nil {
-		ses.Data = make(map[string]interface{})
+	} else {
+		if ses.Origin.IsZero() {
+			ses.Origin = time.Now()
+		}
+		if ses.Tstamp.IsZero() {
+			ses.Tstamp = time.Now()
+		}
+		if ses.Data == nil {
+			ses.Data = make(map[string]interface{})
+		}
 	}
 	s.Lock()
+	defer s.Unlock()
+	s.index(id, s.shelf[id], ses)
 	s.shelf[id] = ses
+	s.used(id)
+	s.evict()
 	return nil
 }
 
 // Read retrieves Session from store
 // Takes session ID
 // If session not found returns ErrSessionNoRecord error
+// Returned copy owns its data maps and is safe to use alongside concurrent updates
+// Capacity bound store takes the write lock to record access order
 func (s *MemoryStore) Read(id string) (*Session, error) {
-	s.RLock()
-	defer s.RUnlock()
+	if id == "" {
+		return nil, ErrEmptyID
+	}
+	if s.lru != nil {
+		s.Lock()
+		defer s.Unlock()
+	} else {
+		s.RLock()
+		defer s.RUnlock()
+	}
 	if ses, ok := s.shelf[id]; ok {
-		scp := *ses
-		return &scp, nil
+		s.used(id)
+		return ses.copy(), nil
 	}
 	return nil, ErrSessionNoRecord
 }
@@ -68,34 +111,220 @@ func (s *MemoryStore) Read(id string) (*Session, error) {
 // Update runs a function on Session
 // Takes session ID and a function with Session as parameter
 // If session not found returns ErrSessionNoRecord error
+// Function runs on a copy outside of the store lock. The copy is committed only if the record
+// was not modified meanwhile, otherwise the function is retried on a fresh copy
 func (s *MemoryStore) Update(id string, fn func(*Session)) (err error) {
-	s.Lock()
-	defer s.Unlock()
-	if ses, ok := s.shelf[id]; ok {
-		fn(ses)
-		return nil
+	if id == "" {
+		return ErrEmptyID
+	}
+	for {
+		s.RLock()
+		cur, ok := s.shelf[id]
+		s.RUnlock()
+		if !ok {
+			return ErrSessionNoRecord
+		}
+		scp := cur.copy()
+		fn(scp)
+		s.Lock()
+		if s.shelf[id] == cur {
+			s.index(id, cur, scp)
+			s.shelf[id] = scp
+			s.used(id)
+			s.Unlock()
+			return nil
+		}
+		s.Unlock()
 	}
-	return ErrSessionNoRecord
 }
 
 // Delete removes Session from the store
 // Takes session ID
 func (s *MemoryStore) Delete(id string) error {
+	if id == "" {
+		return ErrEmptyID
+	}
 	s.Lock()
 	defer s.Unlock()
+	s.index(id, s.shelf[id], nil)
 	delete(s.shelf, id)
+	s.forget(id)
+	return nil
+}
+
+// Ping always succeeds
+func (s *MemoryStore) Ping() error {
 	return nil
 }
 
 // Expire removes expired records
 // Takes expiration duration
 func (s *MemoryStore) Expire(exp time.Duration) (err error) {
+	return s.ExpireFunc(exp, nil)
+}
+
+// ExpireFunc removes expired records calling a function before each deletion
+// Takes expiration duration and a function with session ID and Session as parameters or nil
+// Function runs under store lock and must not call back into the store
+func (s *MemoryStore) ExpireFunc(exp time.Duration, fn func(string, *Session)) (err error) {
+	return s.sweep(func(_ string, ses *Session) bool {
+		return time.Now().After(ses.Origin.Add(exp))
+	}, fn)
+}
+
+// ExpireIdle removes records inactive for longer than idle duration
+// Records with own idle timeout use it instead, negative timeout keeps the record
+// Takes idle duration
+func (s *MemoryStore) ExpireIdle(idle time.Duration) error {
+	return s.sweep(func(_ string, ses *Session) bool {
+		return ses.idled(idle, time.Now())
+	}, nil)
+}
+
+// Sweep removes records for which stale function of session ID and Session reports true
+// Function runs under store lock and must not call back into the store
+func (s *MemoryStore) Sweep(stale func(string, *Session) bool) error {
+	return s.sweep(stale, nil)
+}
+
+// Sweep removes records matching stale function calling fn before each deletion
+func (s *MemoryStore) sweep(stale func(string, *Session) bool, fn func(string, *Session)) (err error) {
 	s.Lock()
 	for key, ses := range s.shelf {
-		if time.Now().After(ses.Origin.Add(exp)) {
+		if stale(key, ses) {
+			if fn != nil {
+				fn(key, ses)
+			}
+			s.index(key, ses, nil)
 			delete(s.shelf, key)
+			s.forget(key)
 		}
 	}
 	s.Unlock()
 	return
 }
+
+// Count returns number of session records
+func (s *MemoryStore) Count() (int, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.shelf), nil
+}
+
+// Number of records gob encoded by Stats to estimate memory usage
+const statsSample = 100
+
+// Stats returns number of session records and estimate of their size in bytes
+// Size is extrapolated from gob encoded size of up to statsSample records picked at random
+// Records failing to encode are left out of the sample
+func (s *MemoryStore) Stats() (count int, approxBytes int) {
+	s.RLock()
+	defer s.RUnlock()
+	count = len(s.shelf)
+	var size, num int
+	for id, ses := range s.shelf {
+		if num == statsSample {
+			break
+		}
+		bts, err := encGob(ses)
+		if err != nil {
+			continue
+		}
+		size += len(id) + len(bts)
+		num++
+	}
+	if num > 0 {
+		approxBytes = size * count / num
+	}
+	return
+}
+
+// List returns IDs of all session records
+func (s *MemoryStore) List() ([]string, error) {
+	s.RLock()
+	defer s.RUnlock()
+	ids := make([]string, 0, len(s.shelf))
+	for key := range s.shelf {
+		ids = append(ids, key)
+	}
+	return ids, nil
+}
+
+// ListUser returns IDs of session records owned by the user
+// Served from the store user index
+func (s *MemoryStore) ListUser(uid string) ([]string, error) {
+	s.RLock()
+	defer s.RUnlock()
+	ids := make([]string, 0, len(s.users[uid]))
+	for key := range s.users[uid] {
+		ids = append(ids, key)
+	}
+	return ids, nil
+}
+
+// Index moves session ID between user index entries when record owner changes
+// Takes session ID, replaced record and new record, either may be nil. Must run under store lock
+func (s *MemoryStore) index(id string, old, ses *Session) {
+	var was, now string
+	if old != nil {
+		was = old.User
+	}
+	if ses != nil {
+		now = ses.User
+	}
+	if was == now {
+		return
+	}
+	if was != "" {
+		delete(s.users[was], id)
+		if len(s.users[was]) == 0 {
+			delete(s.users, was)
+		}
+	}
+	if now != "" {
+		if s.users[now] == nil {
+			s.users[now] = make(map[string]struct{})
+		}
+		s.users[now][id] = struct{}{}
+	}
+}
+
+// Used marks session ID as most recently used. Must run under store lock
+func (s *MemoryStore) used(id string) {
+	if s.lru == nil {
+		return
+	}
+	if el, ok := s.lru.elems[id]; ok {
+		s.lru.order.MoveToFront(el)
+		return
+	}
+	s.lru.elems[id] = s.lru.order.PushFront(id)
+}
+
+// Forget drops session ID from access order. Must run under store lock
+func (s *MemoryStore) forget(id string) {
+	if s.lru == nil {
+		return
+	}
+	if el, ok := s.lru.elems[id]; ok {
+		s.lru.order.Remove(el)
+		delete(s.lru.elems, id)
+	}
+}
+
+// Evict removes least recently used sessions over capacity. Must run under store lock
+func (s *MemoryStore) evict() {
+	if s.lru == nil {
+		return
+	}
+	for len(s.shelf) > s.lru.cap {
+		el := s.lru.order.Back()
+		if el == nil {
+			return
+		}
+		id := el.Value.(string)
+		s.index(id, s.shelf[id], nil)
+		delete(s.shelf, id)
+		s.forget(id)
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright (c), Ruslan Sendecky. All rights reserved
+// Use of this source code is governed by the MIT license
+// See the LICENSE file in the project root for more information
+
+package gsession
+
+// Migrate copies all session records from src to dst store
+// Source store must implement Lister, otherwise ErrStoreUnsupported is returned
+// Timestamps, token and data are preserved
+// Existing destination records are overwritten only when overwrite is true
+func Migrate(dst, src Store, overwrite bool) error {
+	lst, ok := src.(Lister)
+	if !ok {
+		return ErrStoreUnsupported
+	}
+	ids, err := lst.List()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		ses, err := src.Read(id)
+		if err != nil {
+			if err == ErrSessionNoRecord {
+				continue
+			}
+			return err
+		}
+		if !overwrite {
+			_, err = dst.Read(id)
+			if err == nil {
+				continue
+			}
+			if err != ErrSessionNoRecord {
+				return err
+			}
+		}
+		err = dst.Create(id, ses)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+// Copyright (c), Ruslan Sendecky. All rights reserved
+// Use of this source code is governed by the MIT license
+// See the LICENSE file in the project root for more information
+
+package gsession
+
+import (
+	"sync"
+	"time"
+)
+
+// NullStore keeps a single in-memory session shared by every ID and persists nothing
+// Writes stay visible until the next Create or Delete, so handlers can Set and Get within a request
+// Intended for handler tests that do not depend on persistence
+type NullStore struct {
+	// Fixed is the initial state of the session when set, otherwise a fresh empty session is used
+	Fixed *Session
+	mu    sync.Mutex
+	ses   *Session
+}
+
+// NewNullStore creates a new null store
+// Takes fixed initial session or nil
+func NewNullStore(fixed *Session) *NullStore {
+	return &NullStore{Fixed: fixed}
+}
+
+// Create starts a new current session from the fixed session, the given one or a fresh empty session
+func (s *NullStore) Create(id string, ses *Session) error {
+	if id == "" {
+		return ErrEmptyID
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ses = nil
+	if s.Fixed == nil && ses != nil {
+		s.ses = ses.copy()
+	}
+	return nil
+}
+
+// Read returns a copy of the current session
+// Never returns ErrSessionNoRecord, empty ID returns ErrEmptyID
+func (s *NullStore) Read(id string) (*Session, error) {
+	if id == "" {
+		return nil, ErrEmptyID
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current().copy(), nil
+}
+
+// Update runs a function on the current session
+func (s *NullStore) Update(id string, fn func(*Session)) error {
+	if id == "" {
+		return ErrEmptyID
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(s.current())
+	return nil
+}
+
+// Returns current session, started from the fixed session or fresh when missing
+func (s *NullStore) current() *Session {
+	if s.ses == nil {
+		if s.Fixed != nil {
+			s.ses = s.Fixed.copy()
+		} else {
+			now := time.Now()
+			s.ses = &Session{Origin: now, Tstamp: now, Data: make(map[string]interface{})}
+		}
+	}
+	return s.ses
+}
+
+// Delete discards the current session
+func (s *NullStore) Delete(id string) error {
+	if id == "" {
+		return ErrEmptyID
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ses = nil
+	return nil
+}
+
+// Ping always succeeds
+func (s *NullStore) Ping() error {
+	return nil
+}
+
+// Expire does nothing
+func (s *NullStore) Expire(exp time.Duration) error {
+	return nil
+}
+
+// Count always reports zero records
+func (s *NullStore) Count() (int, error) {
+	return 0, nil
+}
+
+// List always returns no IDs
+func (s *NullStore) List() ([]string, error) {
+	return nil, nil
+}
@@ -0,0 +1,396 @@
+// Copyright (c), Ruslan Sendecky. All rights reserved
+// Use of this source code is governed by the MIT license
+// See the LICENSE file in the project root for more information
+
+package gsession
+
+import (
+	"net/http"
+	"time"
+)
+
+// Option configures session manager
+type Option func(*Manager)
+
+// Default manager settings
+const (
+	defName   = "gsession"
+	defExpiry = time.Hour * 24
+	defIdle   = time.Hour * 1
+	defRenew  = time.Minute * 30
+)
+
+// WithExpiry sets absolute session expiry
+// Zero or negative value disables expiry
+func WithExpiry(d time.Duration) Option {
+	return func(m *Manager) {
+		m.expiry = d
+	}
+}
+
+// WithIdle sets session idle timeout
+// Zero or negative value disables idle timeout
+// With renewal and request count rotation also disabled passing requests make no store writes
+func WithIdle(d time.Duration) Option {
+	return func(m *Manager) {
+		m.idle = d
+	}
+}
+
+// WithRenew sets session ID renewal timeout
+// Zero or negative value disables renewal
+func WithRenew(d time.Duration) Option {
+	return func(m *Manager) {
+		m.renew = d
+	}
+}
+
+// WithCookieName sets session cookie name
+// Empty name keeps the default "gsession"
+func WithCookieName(name string) Option {
+	return func(m *Manager) {
+		if name != "" {
+			m.name = name
+		}
+	}
+}
+
+// WithLegacyCookieNames honors session cookies under previous names during a cookie rename
+// Names are checked in order after the current name. Sessions found are kept and the cookie is
+// reissued under the current name, the legacy cookie is expired
+func WithLegacyCookieNames(names ...string) Option {
+	return func(m *Manager) {
+		m.legacy = append(m.legacy, names...)
+	}
+}
+
+// WithSessionInitializer sets a function building initial record of new sessions
+// Runs for sessions created by the middleware and for replacement sessions
+// Nil result falls back to an empty session, zero timestamps are set to the current time
+func WithSessionInitializer(fn func(r *http.Request) *Session) Option {
+	return func(m *Manager) {
+		m.initer = fn
+	}
+}
+
+// WithHooks registers session lifecycle callbacks
+// May be supplied multiple times, hooks run in registration order
+func WithHooks(h Hooks) Option {
+	return func(m *Manager) {
+		m.hooks = append(m.hooks, h)
+	}
+}
+
+// WithLogger sets logger for session manager trace events
+// Nil logger keeps the default no-op
+func WithLogger(l Logger) Option {
+	return func(m *Manager) {
+		if l != nil {
+			m.log = l
+		}
+	}
+}
+
+// WithMaxDataBytes limits gob encoded size of session data
+// Writes exceeding the limit return ErrSessionTooLarge
+// Zero or negative value disables the limit
+func WithMaxDataBytes(n int) Option {
+	return func(m *Manager) {
+		m.maxBytes = n
+	}
+}
+
+// WithMaxKeys limits number of distinct session data keys
+// Adding a new key past the limit returns ErrSessionKeyLimit, existing keys can still be updated
+// Zero or negative value disables the limit
+func WithMaxKeys(n int) Option {
+	return func(m *Manager) {
+		m.maxKeys = n
+	}
+}
+
+// WithFailOpen sets middleware behaviour on session validation store errors
+// When true a fresh session is issued instead of failing the request
+// Default is false, store errors fail the request
+func WithFailOpen(open bool) Option {
+	return func(m *Manager) {
+		m.failOpen = open
+	}
+}
+
+// WithClock sets time source used for session timestamps and validation
+// Intended for deterministic tests, nil keeps the default time.Now
+func WithClock(now func() time.Time) Option {
+	return func(m *Manager) {
+		if now != nil {
+			m.now = now
+		}
+	}
+}
+
+// WithDebugHeader echoes current session ID in the named response header
+// WARNING: session ID is a bearer credential. Anything able to read response headers
+// (proxies, logs, client scripts) can hijack the session. Never enable in production
+func WithDebugHeader(name string) Option {
+	return func(m *Manager) {
+		m.debugHdr = name
+	}
+}
+
+// WithKeyPrefix prefixes store keys with the cookie name
+// Allows several managers with distinct cookie names to share one store
+// Background cleanup then removes only own records through stores implementing Sweeper
+func WithKeyPrefix(on bool) Option {
+	return func(m *Manager) {
+		m.prefix = on
+	}
+}
+
+// WithExpiryGrace sets grace window past absolute expiry
+// Sessions within the window are renewed once instead of expired to tolerate client clock skew
+// Later requests within the window pass with the renewed ID
+func WithExpiryGrace(d time.Duration) Option {
+	return func(m *Manager) {
+		m.grace = d
+	}
+}
+
+// WithHttpOnly sets HttpOnly attribute of the session cookie, default is true
+// WARNING: disabling it exposes session ID to client scripts, any XSS flaw then leaks the session
+func WithHttpOnly(on bool) Option {
+	return func(m *Manager) {
+		m.httpOnly = on
+	}
+}
+
+// WithHostPrefix prefixes session cookie name with "__Host-"
+// Cookie is then forced to be Secure with Path=/ and no Domain as the prefix requires
+// Secure cookies are only sent over HTTPS
+func WithHostPrefix(on bool) Option {
+	return func(m *Manager) {
+		m.hostPrefix = on
+	}
+}
+
+// WithStoreTimeout bounds each store operation attempt to d
+// Operations running longer return ErrStoreTimeout and are not retried
+// Stuck operations are left running in background. Zero disables the timeout
+func WithStoreTimeout(d time.Duration) Option {
+	return func(m *Manager) {
+		m.timeout = d
+	}
+}
+
+// WithStoreRetry retries failed store operations up to attempts times in total
+// Waits backoff multiplied by attempt number between tries
+// ErrSessionNoRecord is never retried, retries stop once the request context is done
+func WithStoreRetry(attempts int, backoff time.Duration) Option {
+	return func(m *Manager) {
+		m.attempts = attempts
+		m.backoff = backoff
+	}
+}
+
+// WithMaxRotations limits number of session ID rotations
+// Once exceeded the session is replaced with a fresh one without data
+// Zero or negative value disables the limit
+func WithMaxRotations(n int) Option {
+	return func(m *Manager) {
+		m.maxRot = n
+	}
+}
+
+// WithRefreshCookie re-writes session cookie on every passing request
+// Propagates cookie attribute changes to returning clients at the cost of a header per response
+func WithRefreshCookie(on bool) Option {
+	return func(m *Manager) {
+		m.refresh = on
+	}
+}
+
+// StoreOption configures persistent session stores
+type StoreOption func(*storeConfig)
+
+// Persistent store settings
+type storeConfig struct {
+	log    Logger
+	codec  Codec
+	prefix string
+}
+
+// Returns store settings with options applied over defaults
+func newStoreConfig(opts []StoreOption) *storeConfig {
+	cfg := &storeConfig{
+		log:   func(string, string, ...interface{}) {},
+		codec: GobCodec{},
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// StoreLogger sets logger for store background tasks such as value log GC and expiry sweeps
+// Nil logger keeps the default no-op
+func StoreLogger(l Logger) StoreOption {
+	return func(c *storeConfig) {
+		if l != nil {
+			c.log = l
+		}
+	}
+}
+
+// StorePrefix namespaces file store keys so the database can hold other data
+// Only keys starting with the prefix are read, counted, listed and expired
+// Ignored by bolt store which keeps sessions in own bucket
+func StorePrefix(prefix string) StoreOption {
+	return func(c *storeConfig) {
+		c.prefix = prefix
+	}
+}
+
+// StoreCodec sets session serialization codec of the store
+// Nil codec keeps the default GobCodec
+func StoreCodec(codec Codec) StoreOption {
+	return func(c *storeConfig) {
+		if codec != nil {
+			c.codec = codec
+		}
+	}
+}
+
+// WithTouchBuffer coalesces session activity timestamp writes in memory
+// Buffered timestamps are flushed to the store every interval, idle validation consults them
+// Activity not yet flushed is lost if the process stops without calling Shutdown
+func WithTouchBuffer(interval time.Duration) Option {
+	return func(m *Manager) {
+		m.buffer = interval
+	}
+}
+
+// WithSigningKey signs session cookies with HMAC-SHA256 and embeds their issue time
+// Cookies past absolute expiry are then rejected without a store read
+// Cookies with a missing or bad signature are treated as invalid. Nil key disables signing
+func WithSigningKey(key []byte) Option {
+	return func(m *Manager) {
+		m.signKeys = nil
+		if key != nil {
+			m.signKeys = [][]byte{key}
+		}
+	}
+}
+
+// WithSigningKeys signs session cookies with current key and accepts cookies signed with previous keys
+// Cookies signed with a previous key are re-signed with the current key
+// Use it to rotate a compromised key without logging users out. Nil current key disables signing
+func WithSigningKeys(current []byte, previous ...[]byte) Option {
+	return func(m *Manager) {
+		m.signKeys = nil
+		if current != nil {
+			m.signKeys = append([][]byte{current}, previous...)
+		}
+	}
+}
+
+// WithCookieWriter sets function writing session cookies to responses
+// Use it to emit attributes http.Cookie lacks, such as Partitioned
+// Nil writer keeps the default http.SetCookie
+func WithCookieWriter(fn func(w http.ResponseWriter, c *http.Cookie)) Option {
+	return func(m *Manager) {
+		if fn != nil {
+			m.writer = fn
+		}
+	}
+}
+
+// WithRotateEvery rotates session ID after every n validated requests keeping session data
+// Each request then writes its counter to the store, touch buffering and async writes do not count requests
+// Zero or negative value disables rotation
+func WithRotateEvery(n int) Option {
+	return func(m *Manager) {
+		m.rotEvery = n
+	}
+}
+
+// WithIDGenerator sets session ID generator
+// Cookies not accepted by the generator are replaced without a store read
+// Nil generator keeps the default UUIDGenerator
+func WithIDGenerator(g IDGenerator) Option {
+	return func(m *Manager) {
+		if g != nil {
+			m.ids = g
+		}
+	}
+}
+
+// WithAutoRegister registers session on the fly for Remove, Regenerate and Destroy called without session context
+// Accessors without response writer still return ErrSessionNilContext
+func WithAutoRegister(on bool) Option {
+	return func(m *Manager) {
+		m.autoReg = on
+	}
+}
+
+// WithValidator adds custom session validation run after built-in expiry and idle checks
+// Sessions the function rejects are deleted and replaced with a new empty session
+// Function must not modify the session. May be supplied multiple times
+func WithValidator(fn func(*Session) bool) Option {
+	return func(m *Manager) {
+		if fn != nil {
+			m.validators = append(m.validators, fn)
+		}
+	}
+}
+
+// WithRotationHeader sets response header reporting middleware session ID rotation
+// Header value is "idle", "renew" or "rotate". Empty name disables the header
+func WithRotationHeader(name string) Option {
+	return func(m *Manager) {
+		m.rotHdr = name
+	}
+}
+
+// WithErrorHandler sets function responding to requests the middleware failed to register
+// Default logs the error and responds with static 500 message. Nil handler keeps the default
+func WithErrorHandler(fn func(w http.ResponseWriter, r *http.Request, err error)) Option {
+	return func(m *Manager) {
+		if fn != nil {
+			m.onError = fn
+		}
+	}
+}
+
+// WithClientMeta captures client address and user agent into metadata of new sessions
+// Stored under MetaRemoteAddr and MetaUserAgent keys
+func WithClientMeta(on bool) Option {
+	return func(m *Manager) {
+		m.capture = on
+	}
+}
+
+// WithBindToClient binds sessions to client address and/or user agent captured on create
+// Requests with a different fingerprint get the session deleted and a new one issued
+// Sessions without captured metadata are rejected too. Client address is compared without port
+func WithBindToClient(b Binding) Option {
+	return func(m *Manager) {
+		m.bind = b
+	}
+}
+
+// WithAsyncWrites moves activity timestamp writes of passing requests to a background worker
+// Write errors are reported to the logger. Session create and reset stay synchronous
+// Queued writes are completed by Shutdown
+// Touch buffering takes precedence when both are enabled
+func WithAsyncWrites(on bool) Option {
+	return func(m *Manager) {
+		m.async = on
+	}
+}
+
+// WithSlidingCookie re-writes session cookie on every passing request to expire with the idle timeout
+// Cookie expiry advances with activity and never outlives the session absolute expiry
+func WithSlidingCookie(on bool) Option {
+	return func(m *Manager) {
+		m.slide = on
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright (c), Ruslan Sendecky. All rights reserved
+// Use of this source code is governed by the MIT license
+// See the LICENSE file in the project root for more information
+
+//go:build otel
+
+package gsession
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WithTracer creates OpenTelemetry spans for session registration, validation, Set, Get and store calls
+// Spans carry operation name and a hash of the session ID, never the ID itself
+// Build with "otel" tag to include it
+func WithTracer(t trace.Tracer) Option {
+	return func(m *Manager) {
+		if t == nil {
+			return
+		}
+		m.tracer = func(ctx context.Context, op, id string) (context.Context, func(error)) {
+			if id == "" {
+				id, _ = SessionIDFromContext(ctx)
+			}
+			attrs := []attribute.KeyValue{attribute.String("gsession.operation", op)}
+			if id != "" {
+				attrs = append(attrs, attribute.String("gsession.session_id_hash", idHash(id)))
+			}
+			ctx, span := t.Start(ctx, "gsession."+op, trace.WithAttributes(attrs...))
+			return ctx, func(err error) {
+				if err != nil && err != ErrSessionNoRecord && err != ErrSessionKeyInvalid {
+					span.RecordError(err)
+					span.SetStatus(codes.Error, err.Error())
+				}
+				span.End()
+			}
+		}
+	}
+}
+
+// Returns truncated SHA-256 hex digest of session ID
+func idHash(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
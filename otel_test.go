@@ -0,0 +1,57 @@
+// Copyright (c), Ruslan Sendecky. All rights reserved
+// Use of this source code is governed by the MIT license
+// See the LICENSE file in the project root for more information
+
+//go:build otel
+
+package gsession
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracer(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	man := NewWithOptions(NewMemoryStore(), WithTracer(tp.Tracer("gsession")))
+	handler := man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		man.Set(r, "key", "val")
+		man.Get(r, "key")
+	}))
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/", nil))
+	id := res.Result().Cookies()[0].Value
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range rec.Ended() {
+		spans[span.Name()] = span
+		for _, attr := range span.Attributes() {
+			if strings.Contains(attr.Value.Emit(), id) {
+				t.Fatal("raw session ID should not be recorded")
+			}
+		}
+	}
+	for _, name := range []string{"gsession.register", "gsession.store.create", "gsession.set", "gsession.store.update", "gsession.get", "gsession.store.read"} {
+		if spans[name] == nil {
+			t.Fatalf("span %s missing", name)
+		}
+	}
+	if spans["gsession.store.create"].Parent().SpanID() != spans["gsession.register"].SpanContext().SpanID() {
+		t.Fatal("store span should be a child of the register span")
+	}
+	var hashed bool
+	for _, attr := range spans["gsession.set"].Attributes() {
+		if attr.Key == "gsession.session_id_hash" && attr.Value.AsString() == idHash(id) {
+			hashed = true
+		}
+	}
+	if !hashed {
+		t.Fatal("span should carry session ID hash")
+	}
+}
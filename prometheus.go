@@ -0,0 +1,75 @@
+// Copyright (c), Ruslan Sendecky. All rights reserved
+// Use of this source code is governed by the MIT license
+// See the LICENSE file in the project root for more information
+
+//go:build prometheus
+
+package gsession
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Collector exports session manager metrics to Prometheus
+// Build with "prometheus" tag to include it
+type Collector struct {
+	man     *Manager
+	created prometheus.Counter
+	expired prometheus.Counter
+	idled   prometheus.Counter
+	renewed prometheus.Counter
+	active  *prometheus.Desc
+}
+
+// NewCollector creates a new collector and wires it into manager lifecycle hooks
+// Call it before the manager starts serving requests
+// Active session gauge is reported only for stores implementing Counter
+func NewCollector(m *Manager) *Collector {
+	c := &Collector{
+		man: m,
+		created: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gsession_created_total",
+			Help: "Number of sessions created.",
+		}),
+		expired: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gsession_expired_total",
+			Help: "Number of sessions expired.",
+		}),
+		idled: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gsession_idle_rotations_total",
+			Help: "Number of session IDs rotated after idle timeout.",
+		}),
+		renewed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gsession_renewals_total",
+			Help: "Number of session IDs renewed.",
+		}),
+		active: prometheus.NewDesc("gsession_active", "Number of session records in the store.", nil, nil),
+	}
+	m.hooks = append(m.hooks, Hooks{
+		Created: func(string) { c.created.Inc() },
+		Expired: func(string) { c.expired.Inc() },
+		Idled:   func(string) { c.idled.Inc() },
+		Renewed: func(string) { c.renewed.Inc() },
+	})
+	return c
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.created.Describe(ch)
+	c.expired.Describe(ch)
+	c.idled.Describe(ch)
+	c.renewed.Describe(ch)
+	ch <- c.active
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.created.Collect(ch)
+	c.expired.Collect(ch)
+	c.idled.Collect(ch)
+	c.renewed.Collect(ch)
+	if cnt, ok := c.man.store.(Counter); ok {
+		if num, err := cnt.Count(); err == nil {
+			ch <- prometheus.MustNewConstMetric(c.active, prometheus.GaugeValue, float64(num))
+		}
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright (c), Ruslan Sendecky. All rights reserved
+// Use of this source code is governed by the MIT license
+// See the LICENSE file in the project root for more information
+
+//go:build prometheus
+
+package gsession
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	man := New(NewMemoryStore(), 0, 0, 0)
+	col := NewCollector(man)
+	handler := man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	jar := rec.Result().Cookies()[0]
+	if testutil.ToFloat64(col.created) != 1 {
+		t.Fatal("created counter should increment")
+	}
+
+	err := man.store.Update(jar.Value, func(ses *Session) {
+		ses.Tstamp = time.Now().Add(-2 * time.Hour)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(jar)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if testutil.ToFloat64(col.idled) != 1 {
+		t.Fatal("idle counter should increment")
+	}
+	if testutil.CollectAndCount(col) != 5 {
+		t.Fatal("collector should report counters and active gauge")
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c), Ruslan Sendecky. All rights reserved
+// Use of this source code is governed by the MIT license
+// See the LICENSE file in the project root for more information
+
+package gsession
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Namespace key separator
+const scopeSep = "."
+
+// ScopedManager provides isolated slice of session data
+// Keys are prefixed with namespace inside the same session record
+type ScopedManager struct {
+	man    *Manager
+	prefix string
+	err    error
+}
+
+// Namespace returns scoped manager for the given namespace name
+// Names containing the key separator are rejected by all scoped methods with ErrNamespaceInvalid
+func (m *Manager) Namespace(name string) *ScopedManager {
+	s := &ScopedManager{
+		man:    m,
+		prefix: name + scopeSep,
+	}
+	if strings.Contains(name, scopeSep) {
+		s.err = ErrNamespaceInvalid
+	}
+	return s
+}
+
+// Set sets new namespaced session key/value pair
+// Takes HTTP request, key and value
+func (s *ScopedManager) Set(r *http.Request, key string, val string) error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.man.Set(r, s.prefix+key, val)
+}
+
+// SetAny sets new namespaced session key/value pair of any type
+// Takes HTTP request, key and value
+func (s *ScopedManager) SetAny(r *http.Request, key string, val interface{}) error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.man.SetAny(r, s.prefix+key, val)
+}
+
+// Get returns namespaced session data
+// Takes HTTP request and data key
+func (s *ScopedManager) Get(r *http.Request, key string) (interface{}, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.man.Get(r, s.prefix+key)
+}
+
+// Delete removes namespaced session data
+// Takes HTTP request and key
+func (s *ScopedManager) Delete(r *http.Request, key string) error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.man.Delete(r, s.prefix+key)
+}
@@ -6,53 +6,271 @@ package gsession
 
 import (
 	"context"
+	"crypto/subtle"
 	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/pkg/errors"
 )
 
 // Manager type
 type Manager struct {
-	name   string
-	store  Store
-	expiry time.Duration
-	idle   time.Duration
-	renew  time.Duration
+	name       string
+	legacy     []string
+	store      Store
+	expiry     time.Duration
+	idle       time.Duration
+	renew      time.Duration
+	hooks      []Hooks
+	log        Logger
+	maxBytes   int
+	maxKeys    int
+	failOpen   bool
+	now        func() time.Time
+	debugHdr   string
+	prefix     bool
+	grace      time.Duration
+	httpOnly   bool
+	hostPrefix bool
+	secure     bool
+	attempts   int
+	backoff    time.Duration
+	timeout    time.Duration
+	initer     func(*http.Request) *Session
+	removals   map[string]*removal
+	tracer     func(ctx context.Context, op, id string) (context.Context, func(error))
+	rmu        sync.Mutex
+	maxRot     int
+	refresh    bool
+	buffer     time.Duration
+	touches    *touchBuffer
+	signKeys   [][]byte
+	writer     func(http.ResponseWriter, *http.Cookie)
+	rotEvery   int
+	stats      counters
+	ids        IDGenerator
+	autoReg    bool
+	validators []func(*Session) bool
+	rotHdr     string
+	capture    bool
+	slide      bool
+	bind       Binding
+	async      bool
+	writes     chan touchop
+	drained    chan struct{}
+	wmu        sync.RWMutex
+	closed     bool
+	sweeper    chan bool
+	halt       sync.Once
+	onError    func(http.ResponseWriter, *http.Request, error)
+	tmu        sync.Mutex
+}
+
+// Logger receives session manager trace events
+// Level is one of "debug", "info" or "error", kv holds alternating key/value pairs
+// Session data and IDs are never passed to the logger
+type Logger func(level, msg string, kv ...interface{})
+
+// Hooks holds session lifecycle callbacks
+// Nil callbacks are skipped
+type Hooks struct {
+	Created func(id string)
+	Expired func(id string)
+	Idled   func(id string)
+	Renewed func(id string)
 }
 
 // Store interface
+// Built-in stores reject empty session IDs with ErrEmptyID
 type Store interface {
 	Create(string, *Session) error
 	Read(string) (*Session, error)
 	Update(string, func(*Session)) error
 	Delete(string) error
 	Expire(time.Duration) error
+	Ping() error
+}
+
+// Counter is implemented by stores able to report number of session records
+type Counter interface {
+	Count() (int, error)
+}
+
+// Lister is implemented by stores able to enumerate session IDs
+type Lister interface {
+	List() ([]string, error)
+}
+
+// IdleExpirer is implemented by stores able to remove records by last activity
+type IdleExpirer interface {
+	ExpireIdle(time.Duration) error
+}
+
+// Sweeper is implemented by stores able to remove records selected by session ID and Session
+// Prefixed managers sweep shared stores through it so they only remove their own records
+type Sweeper interface {
+	Sweep(func(string, *Session) bool) error
+}
+
+// UserLister is implemented by stores able to enumerate session IDs of a user
+type UserLister interface {
+	ListUser(uid string) ([]string, error)
+}
+
+// ContextStore is implemented by stores honoring cancellation and deadlines of the request context
+// Manager calls context variants in place of the plain methods when available
+type ContextStore interface {
+	CreateCtx(context.Context, string, *Session) error
+	ReadCtx(context.Context, string) (*Session, error)
+	UpdateCtx(context.Context, string, func(*Session)) error
+	DeleteCtx(context.Context, string) error
+}
+
+// In flight removal of a session ID shared by concurrent Remove calls
+type removal struct {
+	sync.Mutex
+	id   string
+	refs int
 }
 
 // Session struct stores session data
 type Session struct {
-	Origin time.Time
-	Tstamp time.Time
-	Token  string
-	Data   map[string]interface{}
+	Origin time.Time              `json:"origin"`
+	Tstamp time.Time              `json:"tstamp"`
+	Token  string                 `json:"token"`
+	Data   map[string]interface{} `json:"data"`
+	Idle   time.Duration          `json:"idle"`
+	// KeyExpiry holds expiry time of data keys set with TTL
+	KeyExpiry map[string]time.Time `json:"keyExpiry"`
+	// Rotations counts session ID rotations
+	Rotations int `json:"rotations"`
+	// Requests counts validated requests since the last ID rotation
+	Requests int `json:"requests"`
+	// User holds ID of the user owning the session
+	User string `json:"user"`
+	// Blobs holds binary values set with SetBytes apart from Data
+	Blobs map[string][]byte `json:"blobs"`
+	// Meta holds system metadata kept apart from application data
+	Meta map[string]string `json:"meta"`
+}
+
+// Copy returns a copy of Session with its own data maps
+func (s *Session) copy() *Session {
+	scp := *s
+	if s.Data != nil {
+		scp.Data = make(map[string]interface{}, len(s.Data))
+		for k, v := range s.Data {
+			scp.Data[k] = v
+		}
+	}
+	if s.KeyExpiry != nil {
+		scp.KeyExpiry = make(map[string]time.Time, len(s.KeyExpiry))
+		for k, v := range s.KeyExpiry {
+			scp.KeyExpiry[k] = v
+		}
+	}
+	if s.Blobs != nil {
+		scp.Blobs = make(map[string][]byte, len(s.Blobs))
+		for k, v := range s.Blobs {
+			scp.Blobs[k] = append([]byte(nil), v...)
+		}
+	}
+	if s.Meta != nil {
+		scp.Meta = make(map[string]string, len(s.Meta))
+		for k, v := range s.Meta {
+			scp.Meta[k] = v
+		}
+	}
+	return &scp
+}
+
+// Idled reports whether session is past idle timeout
+// Session own idle timeout overrides the given one, negative timeout never idles
+func (s *Session) idled(idle time.Duration, now time.Time) bool {
+	if s.Idle != 0 {
+		idle = s.Idle
+	}
+	return idle > 0 && now.After(s.Tstamp.Add(idle))
+}
+
+// Expired reports whether data key set with TTL has expired
+func (s *Session) expired(key string, now time.Time) bool {
+	exp, ok := s.KeyExpiry[key]
+	return ok && !now.Before(exp)
 }
 
 var (
 	// ErrSessionNilContext  - request session context is nil
-	ErrSessionNilContext = errors.New("request session context is nil")
+	ErrSessionNilContext = errors.New("request session context is nil, wrap the handler with Manager.Use or call Manager.Register first")
 	// ErrSessionKeyInvalid - session data key does not exist or invalid
 	ErrSessionKeyInvalid = errors.New("session data key does not exist or invalid")
 	// ErrSessionNoRecord - session record does not exist or invalid
 	ErrSessionNoRecord = errors.New("session record does not exist or invalid")
+	// ErrSessionTooLarge - session data exceeds configured limit
+	ErrSessionTooLarge = errors.New("session data exceeds configured limit")
+	// ErrSessionKeyLimit - session data key count exceeds configured limit
+	ErrSessionKeyLimit = errors.New("session data key count exceeds configured limit")
+	// ErrStoreUnsupported - store does not support requested operation
+	ErrStoreUnsupported = errors.New("store does not support requested operation")
+	// ErrSessionTypeMismatch - session data value has unexpected type
+	ErrSessionTypeMismatch = errors.New("session data value has unexpected type")
+	// ErrSessionReadOnly - session is read only for the request
+	ErrSessionReadOnly = errors.New("session is read only for the request")
+	// ErrCookieTooLarge - session cookie exceeds browser size limit
+	ErrCookieTooLarge = errors.New("session cookie exceeds browser size limit")
+	// ErrStoreUnavailable - session store is nil
+	ErrStoreUnavailable = errors.New("session store is nil")
+	// ErrReservedKey - session data key uses prefix reserved for internal use
+	ErrReservedKey = errors.New("session data key uses prefix reserved for internal use")
+	// ErrCodecVersion - session record format version is not supported
+	ErrCodecVersion = errors.New("session record format version is not supported")
+	// ErrEmptyID - session ID is empty
+	ErrEmptyID = errors.New("session ID is empty")
+	// ErrStoreTimeout - session store operation timed out
+	ErrStoreTimeout = errors.New("session store operation timed out")
+	// ErrNamespaceInvalid - namespace name contains key separator
+	ErrNamespaceInvalid = errors.New("namespace name contains key separator")
 )
 
-// Context key type
-type ctxkey int
+// Session metadata keys captured by the middleware
+const (
+	MetaRemoteAddr = "remote_addr"
+	MetaUserAgent  = "user_agent"
+)
+
+// ReservedPrefix marks session data keys used by internal features
+// Set and its variants reject keys starting with it
+const ReservedPrefix = "_gs."
+
+// Session metadata key marking a session renewed within expiry grace window
+// SetMeta rejects it and GetMeta does not report it
+const metaGraced = ReservedPrefix + "graced"
+
+// Cookie name prefix requiring Secure, Path=/ and no Domain
+const hostPrefix = "__Host-"
+
+// Maximum serialized cookie size browsers reliably accept
+const maxCookie = 4096
+
+// ContextKey is the type of context key carrying session reference
+// Use SessionIDFromContext to read the session ID
+type ContextKey int
 
 // Context key constant
-const sesID ctxkey = 0
+const sesID ContextKey = 0
+
+// Session reference stored in request context
+// Allows to swap session ID for the rest of the request when it is rotated
+// Read only flag is fixed when the reference is created
+type sesref struct {
+	sync.RWMutex
+	id string
+	ro bool
+}
 
 // Session validation type
 type sesval int
@@ -64,9 +282,21 @@ const (
 	sesExpired
 	sesIdle
 	sesRenew
+	sesRotate
 	sesPass
 )
 
+// Lifecycle hook event type
+type hookev int
+
+// Lifecycle hook event constants
+const (
+	hookCreated hookev = iota
+	hookExpired
+	hookIdled
+	hookRenewed
+)
+
 // Config struct
 type Config struct {
 	expiry, idle, renew time.Duration
@@ -74,234 +304,1161 @@ type Config struct {
 }
 
 // New returns new session manager
+// Zero expiry, idle or renew values fall back to defaults: 24H, 1H and 30M respectively
 func New(store Store, expiry, idle, renew time.Duration) *Manager {
-	if store == nil {
-		store = NewMemoryStore()
-	}
 	if expiry == 0 {
-		expiry = time.Hour * 24
+		expiry = defExpiry
 	}
 	if idle == 0 {
-		idle = time.Hour * 1
+		idle = defIdle
 	}
 	if renew == 0 {
-		renew = time.Minute * 30
+		renew = defRenew
+	}
+	return NewWithOptions(store, WithExpiry(expiry), WithIdle(idle), WithRenew(renew))
+}
+
+// NewWithOptions returns new session manager configured with functional options
+// Pass nil store to get default memory store
+// Store holding a nil pointer makes every store operation return ErrStoreUnavailable
+// Omitted options fall back to defaults
+func NewWithOptions(store Store, opts ...Option) *Manager {
+	if store == nil {
+		store = NewMemoryStore()
+	} else if nilStore(store) {
+		store = nil
 	}
 	man := &Manager{
-		name:   "gsession",
-		store:  store,
-		expiry: expiry,
-		idle:   idle,
-		renew:  renew,
+		name:     defName,
+		store:    store,
+		expiry:   defExpiry,
+		idle:     defIdle,
+		renew:    defRenew,
+		log:      func(string, string, ...interface{}) {},
+		now:      time.Now,
+		httpOnly: true,
+		writer:   http.SetCookie,
+		ids:      UUIDGenerator{},
+		removals: make(map[string]*removal),
+	}
+	man.onError = man.failed
+	for _, opt := range opts {
+		opt(man)
+	}
+	if man.hostPrefix {
+		if !strings.HasPrefix(man.name, hostPrefix) {
+			man.name = hostPrefix + man.name
+		}
+		man.secure = true
+	}
+	if man.buffer > 0 {
+		man.touches = &touchBuffer{
+			tstamps: make(map[string]time.Time),
+			done:    make(chan struct{}),
+		}
+		go man.flusher(man.buffer, man.touches.done)
+	}
+	if man.async {
+		man.writes = make(chan touchop, asyncQueue)
+		man.drained = make(chan struct{})
+		go man.drain(man.writes)
+	}
+	if store != nil {
+		man.sweeper, _ = man.expire(0, man.cleanup)
 	}
-	man.expire(0, store.Expire)
 	return man
 }
 
+// Store returns underlying session store
+// Store keys are prefixed with the cookie name when key prefix option is enabled
+func (m *Manager) Store() Store {
+	return m.store
+}
+
 // Use provides middleware session handler
+// Requests already carrying session context pass through untouched
 func (m *Manager) Use(next http.Handler) http.Handler {
+	return m.use(next, false)
+}
+
+// WrapFunc provides middleware session handler for handler functions
+// Wrapped function receives request carrying session context
+func (m *Manager) WrapFunc(next http.HandlerFunc) http.HandlerFunc {
+	return m.use(next, false).ServeHTTP
+}
+
+// UseReadOnly provides middleware session handler for requests that must not change the session
+// Session writes return ErrSessionReadOnly and validation does not update the activity timestamp
+// Session renewal and expiry are still handled
+// Nested inside Use it makes the already registered session read only for the wrapped handler
+func (m *Manager) UseReadOnly(next http.Handler) http.Handler {
+	return m.use(next, true)
+}
+
+// Use builds middleware session handler
+func (m *Manager) use(next http.Handler, ro bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		id, err := m.register(w, r)
+		if r.Context().Value(sesID) != nil {
+			// Nested read only handler narrows the session registered by outer middleware
+			if ref, err := refCtx(r.Context()); err == nil && ro && !ref.ro {
+				ref = &sesref{id: ref.get(), ro: true}
+				r = r.WithContext(context.WithValue(r.Context(), sesID, ref))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		id, r, err := m.attach(w, r, ro)
 		if err != nil {
-			http.Error(w, err.Error(), 500)
+			m.onError(w, r, err)
 			return
 		}
-		ctx := context.WithValue(r.Context(), sesID, id)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		if m.debugHdr != "" {
+			w.Header().Set(m.debugHdr, id)
+		}
+		next.ServeHTTP(w, r)
 	})
 }
 
+// Ping validates session and updates its activity timestamp, then responds with 204 No Content
+// Use it directly as keep alive route handler. Rotated or new session cookie is written as usual
+// Takes HTTP response and request
+func (m *Manager) Ping(w http.ResponseWriter, r *http.Request) {
+	if r.Context().Value(sesID) == nil {
+		_, err := m.register(w, r, false)
+		if err != nil {
+			m.onError(w, r, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PingStore reports whether the session store is reachable
+// Meant for readiness probes, Ping is the keep alive request handler
+// Returns ErrStoreUnavailable if manager has no store
+func (m *Manager) PingStore() error {
+	if m.store == nil {
+		return ErrStoreUnavailable
+	}
+	return m.store.Ping()
+}
+
+// Register validates and registers session for custom middleware
+// Returns session ID and a copy of the request carrying session context
+func (m *Manager) Register(w http.ResponseWriter, r *http.Request) (string, *http.Request, error) {
+	return m.attach(w, r, false)
+}
+
+// Attach registers session and returns a copy of the request carrying session context
+func (m *Manager) attach(w http.ResponseWriter, r *http.Request, ro bool) (string, *http.Request, error) {
+	id, err := m.register(w, r, ro)
+	if err != nil {
+		return "", nil, err
+	}
+	ref := &sesref{id: id, ro: ro}
+	return id, r.WithContext(context.WithValue(r.Context(), sesID, ref)), nil
+}
+
 // Register validates and registers new session record
-func (m *Manager) register(w http.ResponseWriter, r *http.Request) (string, error) {
+// Read only registration does not update the activity timestamp
+func (m *Manager) register(w http.ResponseWriter, r *http.Request, ro bool) (sid string, err error) {
+	if m.tracer != nil {
+		ctx, end := m.tracer(r.Context(), "register", "")
+		defer func() { end(err) }()
+		r = r.WithContext(ctx)
+	}
 	var id string
-	jar, err := r.Cookie(m.name)
-	if err == nil && jar.Value != "" {
-		id = jar.Value
-		val, err := m.validate(id)
+	raw, old := m.cookie(r)
+	cid, iss, prev, ok := m.unsign(raw)
+	if old != "" {
+		// Legacy cookie is replaced by one under the current name
+		prev = true
+		defer func() {
+			if err == nil {
+				m.dropCookie(w, old)
+			}
+		}()
+	}
+	if ok {
+		id = cid
+		var val sesval
+		var ses *Session
+		if m.lapsed(iss) {
+			m.log("debug", "session cookie past expiry")
+			val = sesExpired
+		} else if m.untracked() {
+			val, ses, err = m.fixed(r.Context(), id, ro)
+		} else if m.touches != nil {
+			val, ses, err = m.buffered(r.Context(), id, !ro)
+		} else if ro {
+			val, ses, err = m.validate(r.Context(), id)
+		} else if m.writes != nil {
+			val, ses, err = m.queued(r.Context(), id)
+		} else {
+			val, ses, err = m.touch(r.Context(), id)
+		}
 		if err != nil {
-			return "", err
+			m.log("error", "session validation failed", "err", err)
+			if !m.failOpen {
+				return "", err
+			}
+		}
+		if ses != nil && val != sesExpired && val != sesInvalid && !m.bound(ses, r) {
+			m.log("info", "session client mismatch")
+			val = sesInvalid
 		}
 		if val == sesPass {
-			err = m.store.Update(id, func(ses *Session) {
-				ses.Tstamp = time.Now()
-			})
-			if err != nil {
-				return "", err
+			if m.slide && ses != nil {
+				err = m.emit(w, m.slideCookie(id, ses))
+				if err != nil {
+					return "", err
+				}
+			} else if m.refresh || prev {
+				err = m.putCookie(w, id)
+				if err != nil {
+					return "", err
+				}
 			}
+			m.log("debug", "session validated")
+			m.stats.validated.Add(1)
 			return id, nil
 		}
-		if val == sesRenew {
-			id, err = m.reset(w, r, id, false)
+		if val == sesRenew || val == sesRotate {
+			id, err = m.reset(w, r, id, ses, false)
+			if err != nil {
+				return "", err
+			}
+			err = m.putCookie(w, id)
 			if err != nil {
 				return "", err
 			}
-			m.putCookie(w, id)
+			if val == sesRotate {
+				m.rotated(w, "rotate")
+				m.log("info", "session rotated")
+			} else {
+				m.rotated(w, "renew")
+				m.log("info", "session renewed")
+			}
+			m.stats.renewed.Add(1)
+			m.fire(hookRenewed, id)
 			return id, nil
 		}
 		if val == sesIdle {
-			id, err = m.reset(w, r, id, true)
+			id, err = m.reset(w, r, id, ses, true)
+			if err != nil {
+				return "", err
+			}
+			err = m.putCookie(w, id)
 			if err != nil {
 				return "", err
 			}
-			m.putCookie(w, id)
+			m.rotated(w, "idle")
+			m.log("info", "session idled")
+			m.stats.idled.Add(1)
+			m.fire(hookIdled, id)
 			return id, nil
 		}
 		if val == sesExpired {
-			err = m.store.Delete(id)
+			err = m.remove(r.Context(), id)
 			if err != nil {
+				m.log("error", "expired session delete failed", "err", err)
 				return "", err
 			}
+			m.log("info", "session expired")
+			m.stats.expired.Add(1)
+			m.fire(hookExpired, id)
+		}
+		if val == sesInvalid {
+			if ses != nil {
+				err = m.remove(r.Context(), id)
+				if err != nil {
+					m.log("error", "rejected session delete failed", "err", err)
+					return "", err
+				}
+			}
+			m.log("info", "session invalid")
+			m.stats.invalid.Add(1)
 		}
+	} else if raw != "" {
+		m.log("info", "session cookie invalid")
+		m.stats.invalid.Add(1)
+	}
+	id = m.ids.New()
+	err = m.create(r.Context(), id, m.spawn(r))
+	if err != nil {
+		m.log("error", "session create failed", "err", err)
+		return "", err
 	}
-	id = uuid.New().String()
-	err = m.store.Create(id, nil)
+	err = m.putCookie(w, id)
 	if err != nil {
 		return "", err
 	}
-	m.putCookie(w, id)
+	m.log("info", "session created")
+	m.stats.created.Add(1)
+	m.fire(hookCreated, id)
 	return id, nil
 }
 
+// Valid reports whether request carries a valid session cookie that needs no renewal
+// Nothing is created, reset or written. Missing or malformed cookie returns false
+// Takes HTTP request
+func (m *Manager) Valid(r *http.Request) (bool, error) {
+	jar, err := r.Cookie(m.name)
+	if err != nil {
+		return false, nil
+	}
+	id, iss, _, ok := m.unsign(jar.Value)
+	if !ok || m.lapsed(iss) {
+		return false, nil
+	}
+	var val sesval
+	var ses *Session
+	if m.touches != nil {
+		val, ses, err = m.buffered(r.Context(), id, false)
+	} else {
+		val, ses, err = m.validate(r.Context(), id)
+	}
+	if err != nil {
+		return false, err
+	}
+	return val == sesPass && m.bound(ses, r), nil
+}
+
+// Touch validates session record and updates its activity timestamp on pass
+// Done in a single store update. Returns a copy of the record read
+// Passing record is copied only when client binding or sliding cookie needs it
+func (m *Manager) touch(ctx context.Context, id string) (sesval, *Session, error) {
+	val := sesError
+	var scp *Session
+	err := m.update(ctx, id, func(ses *Session) {
+		// Store may rerun the function after a conflicting write
+		scp = nil
+		val = m.check(ses)
+		if val == sesPass {
+			ses.Tstamp = m.now()
+			if m.rotEvery > 0 {
+				ses.Requests++
+				if ses.Requests >= m.rotEvery {
+					val = sesRotate
+				}
+			}
+		}
+		if val != sesPass || m.bind != 0 || m.slide {
+			scp = ses.copy()
+		}
+	})
+	if err != nil {
+		if err == ErrSessionNoRecord {
+			m.log("debug", "session record not found")
+			return sesInvalid, nil, nil
+		}
+		if err == ErrCodecVersion {
+			m.log("error", "session record version unsupported")
+			return sesInvalid, nil, nil
+		}
+		return sesError, nil, err
+	}
+	return val, scp, nil
+}
+
+// Untracked reports whether passing requests need no activity timestamp write
+// Holds when idle timeout, renewal and request count rotation are all disabled
+func (m *Manager) untracked() bool {
+	return m.idle <= 0 && m.renew <= 0 && m.rotEvery <= 0
+}
+
+// Fixed validates session record of a manager not tracking activity
+// Activity timestamp is written only for records with own idle timeout
+func (m *Manager) fixed(ctx context.Context, id string, ro bool) (sesval, *Session, error) {
+	val, ses, err := m.validate(ctx, id)
+	if err != nil || ro || val != sesPass || ses.Idle <= 0 {
+		return val, ses, err
+	}
+	return m.touch(ctx, id)
+}
+
 // Validate checks session record, expiry and idle time
-func (m *Manager) validate(id string) (sesval, error) {
-	ses, err := m.store.Read(id)
+// Returns the record read for reuse
+func (m *Manager) validate(ctx context.Context, id string) (_ sesval, ses *Session, err error) {
+	ctx, end := m.trace(ctx, "validate", id)
+	defer func() { end(err) }()
+	ses, err = m.read(ctx, id)
 	if err != nil {
 		if err == ErrSessionNoRecord {
-			return sesInvalid, nil
+			m.log("debug", "session record not found")
+			return sesInvalid, nil, nil
+		}
+		if err == ErrCodecVersion {
+			m.log("error", "session record version unsupported")
+			return sesInvalid, nil, nil
 		}
-		return sesError, err
+		return sesError, nil, err
 	}
-	if m.expiry > 0 {
-		if time.Now().After(ses.Origin.Add(m.expiry)) {
-			return sesExpired, nil
+	return m.check(ses), ses, nil
+}
+
+// Check returns validation outcome for session record
+// Custom validators run after built-in checks unless the session has expired
+func (m *Manager) check(ses *Session) sesval {
+	val := m.timeouts(ses)
+	if val == sesExpired {
+		return val
+	}
+	for _, fn := range m.validators {
+		if !fn(ses) {
+			return sesInvalid
 		}
 	}
-	if m.idle > 0 {
-		if time.Now().After(ses.Tstamp.Add(m.idle)) {
-			return sesIdle, nil
+	return val
+}
+
+// Timeouts returns validation outcome of session expiry, idle and renewal timeouts
+func (m *Manager) timeouts(ses *Session) sesval {
+	if m.expiry > 0 {
+		if m.now().After(ses.Origin.Add(m.expiry + m.grace)) {
+			return sesExpired
+		}
+		if m.now().After(ses.Origin.Add(m.expiry)) && ses.Meta[metaGraced] == "" {
+			return sesRenew
 		}
 	}
+	if ses.idled(m.idle, m.now()) {
+		return sesIdle
+	}
 	if m.renew > 0 {
-		if time.Now().After(ses.Tstamp.Add(m.renew)) {
-			return sesRenew, nil
+		if m.now().After(ses.Tstamp.Add(m.renew)) {
+			return sesRenew
 		}
 	}
-	return sesPass, nil
+	return sesPass
 }
 
 // Set sets new session key/value pair
 // Takes HTTP request, key and value
 func (m *Manager) Set(r *http.Request, key string, val string) error {
-	id, err := sesCtx(r)
-	if err != nil {
-		return err
+	return m.SetAnyCtx(r.Context(), key, val)
+}
+
+// SetCtx sets new session key/value pair
+// Takes context carrying session ID, key and value
+func (m *Manager) SetCtx(ctx context.Context, key string, val string) error {
+	return m.SetAnyCtx(ctx, key, val)
+}
+
+// SetAny sets new session key/value pair of any type
+// Custom types must be registered with gob for persistent stores
+// Takes HTTP request, key and value
+func (m *Manager) SetAny(r *http.Request, key string, val interface{}) error {
+	return m.SetAnyCtx(r.Context(), key, val)
+}
+
+// SetAnyCtx sets new session key/value pair of any type
+// Takes context carrying session ID, key and value
+func (m *Manager) SetAnyCtx(ctx context.Context, key string, val interface{}) (err error) {
+	ctx, end := m.trace(ctx, "set", "")
+	defer func() { end(err) }()
+	if reserved(key) {
+		return ErrReservedKey
 	}
-	err = m.store.Update(id, func(ses *Session) {
+	return m.modify(ctx, func(ses *Session) error {
+		err := m.limit(ses, map[string]interface{}{key: val})
+		if err != nil {
+			return err
+		}
 		ses.Data[key] = val
+		delete(ses.KeyExpiry, key)
+		delete(ses.Blobs, key)
+		return nil
 	})
-	return err
 }
 
-// Get returns session data
-// Takes HTTP request and data key
-func (m *Manager) Get(r *http.Request, key string) (interface{}, error) {
-	id, err := sesCtx(r)
-	if err != nil {
-		return nil, err
-	}
-	ses, err := m.store.Read(id)
-	if err != nil {
-		return nil, err
-	}
-	if dat, ok := ses.Data[key]; ok {
-		return dat, nil
+// SetWithTTL sets new session key/value pair expiring after ttl
+// Expired key is treated as absent and removed lazily on access
+// Takes HTTP request, key, value and time to live
+func (m *Manager) SetWithTTL(r *http.Request, key string, val interface{}, ttl time.Duration) error {
+	if reserved(key) {
+		return ErrReservedKey
 	}
-	return nil, ErrSessionKeyInvalid
+	return m.modify(r.Context(), func(ses *Session) error {
+		err := m.limit(ses, map[string]interface{}{key: val})
+		if err != nil {
+			return err
+		}
+		if ses.KeyExpiry == nil {
+			ses.KeyExpiry = make(map[string]time.Time)
+		}
+		ses.Data[key] = val
+		delete(ses.Blobs, key)
+		ses.KeyExpiry[key] = m.now().Add(ttl)
+		return nil
+	})
 }
 
-// Delete removes session data
-// Takes HTTP request and key
-func (m *Manager) Delete(r *http.Request, key string) error {
-	id, err := sesCtx(r)
-	if err != nil {
-		return err
+// SetMulti sets several session key/value pairs in a single store update
+// Either all pairs are set or none
+// Takes HTTP request and key/value map
+func (m *Manager) SetMulti(r *http.Request, kv map[string]interface{}) error {
+	for key := range kv {
+		if reserved(key) {
+			return ErrReservedKey
+		}
 	}
-	err = m.store.Update(id, func(ses *Session) {
-		delete(ses.Data, key)
+	return m.modify(r.Context(), func(ses *Session) error {
+		err := m.limit(ses, kv)
+		if err != nil {
+			return err
+		}
+		for key, val := range kv {
+			ses.Data[key] = val
+			delete(ses.KeyExpiry, key)
+			delete(ses.Blobs, key)
+		}
+		return nil
 	})
-	return err
 }
 
-// Token sets or gets session token
-// Takes HTTP request and a token string pointer
-// Returns current token or error
-// Pass nil to get the current token
-// Pass string pointer to set a new token
-func (m *Manager) Token(r *http.Request, token *string) (string, error) {
-	id, err := sesCtx(r)
-	if err != nil {
-		return "", err
+// Increment atomically adds delta to numeric session value and returns the result
+// Missing key starts from zero, non numeric value returns ErrSessionTypeMismatch
+// Takes HTTP request, key and delta
+func (m *Manager) Increment(r *http.Request, key string, delta int) (int, error) {
+	if reserved(key) {
+		return 0, ErrReservedKey
 	}
-	if token == nil {
-		ses, err := m.store.Read(id)
+	var res int
+	err := m.modify(r.Context(), func(ses *Session) error {
+		if ses.expired(key, m.now()) {
+			delete(ses.Data, key)
+			delete(ses.KeyExpiry, key)
+		}
+		var cur int
+		switch v := ses.Data[key].(type) {
+		case nil:
+		case int:
+			cur = v
+		case int32:
+			cur = int(v)
+		case int64:
+			cur = int(v)
+		case float64:
+			cur = int(v)
+		default:
+			return ErrSessionTypeMismatch
+		}
+		res = cur + delta
+		err := m.limit(ses, map[string]interface{}{key: res})
 		if err != nil {
-			return "", err
+			return err
 		}
-		return ses.Token, nil
-	}
-	err = m.store.Update(id, func(ses *Session) {
-		ses.Token = *token
+		ses.Data[key] = res
+		delete(ses.Blobs, key)
+		return nil
 	})
 	if err != nil {
-		return "", err
+		return 0, err
 	}
-	return *token, nil
+	return res, nil
 }
 
-// Remove deletes existing session record. Generates new session ID
-// Takes HTTP request and response
-func (m *Manager) Remove(w http.ResponseWriter, r *http.Request) error {
-	id, err := sesCtx(r)
-	if err != nil {
-		return err
+// CompareAndSet sets session value only if the current value equals old, compared with reflect.DeepEqual
+// Missing key matches nil old value. Reports whether the value was swapped
+// Takes HTTP request, key, expected value and new value
+func (m *Manager) CompareAndSet(r *http.Request, key string, old, new interface{}) (bool, error) {
+	if reserved(key) {
+		return false, ErrReservedKey
 	}
-	err = m.store.Delete(id)
+	var swapped bool
+	err := m.modify(r.Context(), func(ses *Session) error {
+		// Store may rerun the function after a conflicting write
+		swapped = false
+		cur, ok := ses.Data[key]
+		if !ok || ses.expired(key, m.now()) {
+			cur = nil
+		}
+		if !reflect.DeepEqual(cur, old) {
+			return nil
+		}
+		err := m.limit(ses, map[string]interface{}{key: new})
+		if err != nil {
+			return err
+		}
+		ses.Data[key] = new
+		delete(ses.KeyExpiry, key)
+		delete(ses.Blobs, key)
+		swapped = true
+		return nil
+	})
 	if err != nil {
-		return err
+		return false, err
 	}
-	id = uuid.New().String()
-	err = m.store.Create(id, nil)
+	return swapped, nil
+}
+
+// Get returns session data
+// Takes HTTP request and data key
+func (m *Manager) Get(r *http.Request, key string) (interface{}, error) {
+	return m.GetCtx(r.Context(), key)
+}
+
+// GetCtx returns session data
+// Takes context carrying session ID and data key
+func (m *Manager) GetCtx(ctx context.Context, key string) (_ interface{}, err error) {
+	ctx, end := m.trace(ctx, "get", "")
+	defer func() { end(err) }()
+	ses, err := m.session(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	m.putCookie(w, id)
-	return nil
+	if ses.expired(key, m.now()) {
+		if ref, _ := refCtx(ctx); ref != nil && ref.ro {
+			// Read only requests leave expired key removal to later writable requests
+			return nil, ErrSessionKeyInvalid
+		}
+		err = m.modify(ctx, func(ses *Session) error {
+			if ses.expired(key, m.now()) {
+				delete(ses.Data, key)
+				delete(ses.KeyExpiry, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrSessionKeyInvalid
+	}
+	if dat, ok := ses.Data[key]; ok {
+		return dat, nil
+	}
+	return nil, ErrSessionKeyInvalid
 }
 
-// Reset generates new session ID. Keeps old session data
-// Set zero parameter to true to reset token to zero and re-touch tstamp
-func (m *Manager) reset(w http.ResponseWriter, r *http.Request, id string, zero bool) (string, error) {
-	osd, err := m.store.Read(id)
+// GetStringOr returns session string value or default on missing key or type mismatch
+// Store errors are still returned
+// Takes HTTP request, data key and default value
+func (m *Manager) GetStringOr(r *http.Request, key, def string) (string, error) {
+	val, err := m.Get(r, key)
 	if err != nil {
-		return "", err
+		if err == ErrSessionKeyInvalid {
+			return def, nil
+		}
+		return def, err
 	}
-	ni := uuid.New().String()
-	if zero {
-		osd.Token = ""
-		osd.Tstamp = time.Now()
+	if str, ok := val.(string); ok {
+		return str, nil
 	}
-	err = m.store.Create(ni, osd)
+	return def, nil
+}
+
+// GetBool returns session value as boolean
+// Accepts bool values, strings parsed by strconv.ParseBool and numbers where non zero is true
+// Other types return ErrSessionTypeMismatch
+// Takes HTTP request and data key
+func (m *Manager) GetBool(r *http.Request, key string) (bool, error) {
+	val, err := m.Get(r, key)
 	if err != nil {
-		return "", err
+		return false, err
 	}
-	err = m.store.Delete(id)
-	if err != nil {
-		return "", err
+	switch v := val.(type) {
+	case bool:
+		return v, nil
+	case string:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, ErrSessionTypeMismatch
+		}
+		return b, nil
+	case int:
+		return v != 0, nil
+	case int64:
+		return v != 0, nil
+	case float64:
+		return v != 0, nil
 	}
-	return ni, nil
+	return false, ErrSessionTypeMismatch
 }
 
-// Runs store Expiry GC every tic period
+// SetTime sets session time value stored as RFC3339 string so it survives any codec
+// Takes HTTP request, key and time
+func (m *Manager) SetTime(r *http.Request, key string, tm time.Time) error {
+	return m.SetAny(r, key, tm.Format(time.RFC3339Nano))
+}
+
+// GetTime returns session value as time
+// Accepts RFC3339 strings written by SetTime and time.Time values
+// Other types return ErrSessionTypeMismatch
+// Takes HTTP request and data key
+func (m *Manager) GetTime(r *http.Request, key string) (time.Time, error) {
+	val, err := m.Get(r, key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	switch v := val.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		tm, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return time.Time{}, ErrSessionTypeMismatch
+		}
+		return tm, nil
+	}
+	return time.Time{}, ErrSessionTypeMismatch
+}
+
+// Delete removes session data
+// Takes HTTP request and key
+func (m *Manager) Delete(r *http.Request, key string) error {
+	return m.DeleteCtx(r.Context(), key)
+}
+
+// DeleteCtx removes session data
+// Takes context carrying session ID and key
+func (m *Manager) DeleteCtx(ctx context.Context, key string) error {
+	return m.modify(ctx, func(ses *Session) error {
+		delete(ses.Data, key)
+		delete(ses.KeyExpiry, key)
+		delete(ses.Blobs, key)
+		return nil
+	})
+}
+
+// SetBytes sets binary session value
+// Bytes are kept apart from other data and stored raw by the gob codec
+// Get does not return them, use GetBytes. Delete removes them
+// Takes HTTP request, key and value
+func (m *Manager) SetBytes(r *http.Request, key string, val []byte) error {
+	if reserved(key) {
+		return ErrReservedKey
+	}
+	return m.modify(r.Context(), func(ses *Session) error {
+		err := m.limit(ses, map[string]interface{}{key: val})
+		if err != nil {
+			return err
+		}
+		if ses.Blobs == nil {
+			ses.Blobs = make(map[string][]byte)
+		}
+		ses.Blobs[key] = append([]byte(nil), val...)
+		delete(ses.Data, key)
+		delete(ses.KeyExpiry, key)
+		return nil
+	})
+}
+
+// GetBytes returns binary session value set with SetBytes
+// Takes HTTP request and key
+func (m *Manager) GetBytes(r *http.Request, key string) ([]byte, error) {
+	ses, err := m.session(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	val, ok := ses.Blobs[key]
+	if !ok {
+		return nil, ErrSessionKeyInvalid
+	}
+	return val, nil
+}
+
+// SetIdle overrides idle timeout for the current session
+// Zero restores manager default, negative disables idle timeout for the session
+// Takes HTTP request and idle duration
+func (m *Manager) SetIdle(r *http.Request, d time.Duration) error {
+	return m.modify(r.Context(), func(ses *Session) error {
+		ses.Idle = d
+		return nil
+	})
+}
+
+// ExpiresIn returns time left until the session expires, grace period included
+// Returns zero past expiry and -1 when expiry is disabled
+// Takes HTTP request
+func (m *Manager) ExpiresIn(r *http.Request) (time.Duration, error) {
+	ses, err := m.session(r.Context())
+	if err != nil {
+		return 0, err
+	}
+	if m.expiry <= 0 {
+		return -1, nil
+	}
+	return remaining(ses.Origin.Add(m.expiry+m.grace), m.now()), nil
+}
+
+// IdleRemaining returns time left until the session idles out
+// Session own idle timeout overrides the manager default
+// Returns zero past idle timeout and -1 when idle timeout is disabled
+// Takes HTTP request
+func (m *Manager) IdleRemaining(r *http.Request) (time.Duration, error) {
+	ses, err := m.session(r.Context())
+	if err != nil {
+		return 0, err
+	}
+	idle := m.idle
+	if ses.Idle != 0 {
+		idle = ses.Idle
+	}
+	if idle <= 0 {
+		return -1, nil
+	}
+	return remaining(ses.Tstamp.Add(idle), m.now()), nil
+}
+
+// Remaining returns duration from now until end, zero if end has passed
+func remaining(end, now time.Time) time.Duration {
+	if left := end.Sub(now); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// Meta returns session creation and last activity timestamps
+// Takes HTTP request
+func (m *Manager) Meta(r *http.Request) (origin, tstamp time.Time, err error) {
+	ses, err := m.session(r.Context())
+	if err != nil {
+		return
+	}
+	return ses.Origin, ses.Tstamp, nil
+}
+
+// Token sets or gets session token
+// Takes HTTP request and a token string pointer
+// Returns current token or error
+// Pass nil to get the current token
+// Pass string pointer to set a new token
+func (m *Manager) Token(r *http.Request, token *string) (string, error) {
+	ref, err := refCtx(r.Context())
+	if err != nil {
+		return "", err
+	}
+	id := ref.get()
+	if token == nil {
+		ses, err := m.read(r.Context(), id)
+		if err != nil {
+			return "", err
+		}
+		return ses.Token, nil
+	}
+	if ref.ro {
+		return "", ErrSessionReadOnly
+	}
+	err = m.update(r.Context(), id, func(ses *Session) {
+		ses.Token = *token
+	})
+	if err != nil {
+		return "", err
+	}
+	return *token, nil
+}
+
+// SetMeta sets session metadata value
+// Takes HTTP request, key and value
+// Keys with ReservedPrefix are rejected with ErrReservedKey
+func (m *Manager) SetMeta(r *http.Request, key, val string) error {
+	if reserved(key) {
+		return ErrReservedKey
+	}
+	return m.modify(r.Context(), func(ses *Session) error {
+		if ses.Meta == nil {
+			ses.Meta = make(map[string]string)
+		}
+		ses.Meta[key] = val
+		return nil
+	})
+}
+
+// GetMeta returns session metadata value
+// Takes HTTP request and key
+// Keys with ReservedPrefix are not reported
+func (m *Manager) GetMeta(r *http.Request, key string) (string, error) {
+	ses, err := m.session(r.Context())
+	if err != nil {
+		return "", err
+	}
+	val, ok := ses.Meta[key]
+	if !ok || reserved(key) {
+		return "", ErrSessionKeyInvalid
+	}
+	return val, nil
+}
+
+// TokenValid reports whether provided token matches session token
+// Comparison runs in constant time. Empty session token never matches
+// Takes HTTP request and provided token
+func (m *Manager) TokenValid(r *http.Request, provided string) (bool, error) {
+	ses, err := m.session(r.Context())
+	if err != nil {
+		return false, err
+	}
+	if ses.Token == "" {
+		return false, nil
+	}
+	return subtle.ConstantTimeCompare([]byte(ses.Token), []byte(provided)) == 1, nil
+}
+
+// SetUser sets ID of the user owning the session
+// User ID is kept across session ID rotations. Empty ID clears it
+// Takes HTTP request and user ID
+func (m *Manager) SetUser(r *http.Request, uid string) error {
+	return m.modify(r.Context(), func(ses *Session) error {
+		ses.User = uid
+		return nil
+	})
+}
+
+// GetUser returns ID of the user owning the session
+// Empty string is returned when no user is set
+// Takes HTTP request
+func (m *Manager) GetUser(r *http.Request) (string, error) {
+	ses, err := m.session(r.Context())
+	if err != nil {
+		return "", err
+	}
+	return ses.User, nil
+}
+
+// Remove deletes existing session record. Generates new session ID
+// Subsequent calls within the same request use the new ID
+// Concurrent calls for the same session share one replacement session
+// Takes HTTP request and response
+func (m *Manager) Remove(w http.ResponseWriter, r *http.Request) error {
+	ref, err := m.wref(w, r)
+	if err != nil {
+		return err
+	}
+	old := ref.get()
+	rm := m.removal(old)
+	rm.Lock()
+	defer m.removed(old, rm)
+	if rm.id == "" {
+		err = m.remove(r.Context(), old)
+		if err != nil {
+			return err
+		}
+		id := m.ids.New()
+		err = m.create(r.Context(), id, m.spawn(r))
+		if err != nil {
+			return err
+		}
+		rm.id = id
+	}
+	err = m.putCookie(w, rm.id)
+	if err != nil {
+		return err
+	}
+	ref.set(rm.id)
+	return nil
+}
+
+// Removal returns in flight removal of session ID registering the caller
+func (m *Manager) removal(id string) *removal {
+	m.rmu.Lock()
+	defer m.rmu.Unlock()
+	rm, ok := m.removals[id]
+	if !ok {
+		rm = new(removal)
+		m.removals[id] = rm
+	}
+	rm.refs++
+	return rm
+}
+
+// Removed releases removal of session ID, forgotten once no callers are left
+func (m *Manager) removed(id string, rm *removal) {
+	rm.Unlock()
+	m.rmu.Lock()
+	defer m.rmu.Unlock()
+	rm.refs--
+	if rm.refs == 0 {
+		delete(m.removals, id)
+	}
+}
+
+// Regenerate rotates session ID keeping session data
+// Use it on privilege elevation to prevent session fixation
+// CSRF token, if issued, is rotated as well
+// Subsequent calls within the same request use the new ID
+// Takes HTTP request and response
+func (m *Manager) Regenerate(w http.ResponseWriter, r *http.Request) error {
+	ref, err := m.wref(w, r)
+	if err != nil {
+		return err
+	}
+	osd, err := m.read(r.Context(), ref.get())
+	if err != nil {
+		return err
+	}
+	osd = osd.copy()
+	if _, ok := osd.Data[csrfKey]; ok {
+		osd.Data[csrfKey] = csrfToken()
+	}
+	id, err := m.reset(w, r, ref.get(), osd, false)
+	if err != nil {
+		return err
+	}
+	err = m.putCookie(w, id)
+	if err != nil {
+		return err
+	}
+	ref.set(id)
+	return nil
+}
+
+// Clone copies session data into a new session record leaving the source intact
+// Clone gets fresh timestamps, no request context is required
+// Takes source session ID and returns the new ID
+func (m *Manager) Clone(srcID string) (string, error) {
+	src, err := m.read(context.Background(), srcID)
+	if err != nil {
+		return "", err
+	}
+	ses := src.copy()
+	ses.Origin = m.now()
+	ses.Tstamp = ses.Origin
+	id := m.ids.New()
+	err = m.create(context.Background(), id, ses)
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Destroy deletes existing session record and expires the session cookie
+// Unlike Remove no replacement session is created
+// Takes HTTP request and response
+func (m *Manager) Destroy(w http.ResponseWriter, r *http.Request) error {
+	ref, err := m.wref(w, r)
+	if err != nil {
+		return err
+	}
+	err = m.remove(r.Context(), ref.get())
+	if err != nil {
+		return err
+	}
+	m.dropCookie(w, m.name)
+	return nil
+}
+
+// Session reads session record referenced by context
+func (m *Manager) session(ctx context.Context) (*Session, error) {
+	id, err := idCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.read(ctx, id)
+}
+
+// Modify runs a function on session record referenced by context
+// Function must not change the session when returning error
+// Nil data map of a malformed record is initialised before the function runs
+func (m *Manager) modify(ctx context.Context, fn func(*Session) error) error {
+	ref, err := wrCtx(ctx)
+	if err != nil {
+		return err
+	}
+	id := ref.get()
+	var ferr error
+	err = m.update(ctx, id, func(ses *Session) {
+		if ses.Data == nil {
+			ses.Data = make(map[string]interface{})
+		}
+		ferr = fn(ses)
+	})
+	if err != nil {
+		return err
+	}
+	return ferr
+}
+
+// Reserved reports whether data key uses the internal prefix
+func reserved(key string) bool {
+	return strings.HasPrefix(key, ReservedPrefix)
+}
+
+// Limit checks session data and blobs with pending changes applied against configured limits
+func (m *Manager) limit(ses *Session, add map[string]interface{}) error {
+	data := make(map[string]interface{}, len(ses.Data)+len(ses.Blobs))
+	for k, v := range ses.Data {
+		data[k] = v
+	}
+	for k, v := range ses.Blobs {
+		data[k] = v
+	}
+	if m.maxKeys > 0 {
+		num := len(data)
+		for k := range add {
+			if _, ok := data[k]; !ok {
+				num++
+			}
+		}
+		if num > m.maxKeys {
+			return ErrSessionKeyLimit
+		}
+	}
+	if m.maxBytes <= 0 {
+		return nil
+	}
+	dat := make(map[string]interface{}, len(data)+len(add))
+	for k, v := range data {
+		dat[k] = v
+	}
+	for k, v := range add {
+		dat[k] = v
+	}
+	bts, err := encGob(dat)
+	if err != nil {
+		return err
+	}
+	if len(bts) > m.maxBytes {
+		return ErrSessionTooLarge
+	}
+	return nil
+}
+
+// Reset generates new session ID. Keeps old session data
+// Past the rotation limit a fresh empty session is created instead
+// Takes already read session record or nil to read it from the store
+// Set zero parameter to true to reset token to zero and re-touch tstamp
+func (m *Manager) reset(w http.ResponseWriter, r *http.Request, id string, osd *Session, zero bool) (string, error) {
+	if osd == nil {
+		var err error
+		osd, err = m.read(r.Context(), id)
+		if err != nil {
+			m.log("error", "session reset read failed", "err", err)
+			return "", err
+		}
+	}
+	ni := m.ids.New()
+	if zero {
+		osd.Token = ""
+		osd.Tstamp = m.now()
+	}
+	osd.Rotations++
+	osd.Requests = 0
+	if m.maxRot > 0 && osd.Rotations > m.maxRot {
+		m.log("info", "session rotation limit reached")
+		osd = m.spawn(r)
+	}
+	if m.expiry > 0 && m.now().After(osd.Origin.Add(m.expiry)) {
+		// Renewed once within grace window, later requests pass until the window ends
+		if osd.Meta == nil {
+			osd.Meta = make(map[string]string)
+		}
+		osd.Meta[metaGraced] = "1"
+	}
+	err := m.create(r.Context(), ni, osd)
+	if err != nil {
+		m.log("error", "session reset create failed", "err", err)
+		return "", err
+	}
+	err = m.remove(r.Context(), id)
+	if err != nil {
+		m.log("error", "session reset delete failed", "err", err)
+		return "", err
+	}
+	m.log("debug", "session reset", "zero", zero)
+	return ni, nil
+}
+
+// Runs store Expiry GC every tic period
 // Removes expired records
 // Takes interval duration and store GC function.
 // If 0 supplied, defaults to every 6 hours
@@ -319,7 +1476,11 @@ func (m *Manager) expire(tic time.Duration, fn func(exp time.Duration) error) (c
 			case <-ticker.C:
 				err := fn(m.expiry)
 				if err != nil {
-					cerr <- err
+					select {
+					case cerr <- err:
+					default:
+						m.log("error", "store expiry failed", "err", err)
+					}
 				}
 			case <-done:
 				return
@@ -329,18 +1490,424 @@ func (m *Manager) expire(tic time.Duration, fn func(exp time.Duration) error) (c
 	return done, cerr
 }
 
+// Cleanup removes expired records and, for stores implementing IdleExpirer, idle records
+// Buffered activity is flushed first so active sessions are not removed as idle
+// Expired records are kept until the end of the grace window so they can still be renewed
+// With key prefix enabled only own records are swept, stores not implementing Sweeper are skipped
+func (m *Manager) cleanup(exp time.Duration) error {
+	if m.prefix {
+		return m.sweep(exp)
+	}
+	if exp > 0 {
+		err := m.store.Expire(exp + m.grace)
+		if err != nil {
+			return err
+		}
+	}
+	ie, ok := m.store.(IdleExpirer)
+	if !ok || m.idle <= 0 {
+		return nil
+	}
+	if m.touches != nil {
+		m.flush()
+	}
+	return ie.ExpireIdle(m.idle)
+}
+
+// Sweep removes expired and idle records of this manager from a shared store
+func (m *Manager) sweep(exp time.Duration) error {
+	sw, ok := m.store.(Sweeper)
+	if !ok {
+		m.log("debug", "store sweep skipped, store does not implement Sweeper")
+		return nil
+	}
+	if m.touches != nil && m.idle > 0 {
+		m.flush()
+	}
+	now := m.now()
+	return sw.Sweep(func(key string, ses *Session) bool {
+		if _, ok := m.unkey(key); !ok {
+			return false
+		}
+		if exp > 0 && now.After(ses.Origin.Add(exp+m.grace)) {
+			return true
+		}
+		return m.idle > 0 && ses.idled(m.idle, now)
+	})
+}
+
+// Key returns store key for session ID
+// Prefixed with cookie name when store key prefix is enabled
+func (m *Manager) key(id string) string {
+	if m.prefix {
+		return m.name + ":" + id
+	}
+	return id
+}
+
+// Unkey returns session ID for store key
+// Reports false for keys of other managers sharing a prefixed store
+func (m *Manager) unkey(key string) (string, bool) {
+	if m.prefix {
+		return strings.CutPrefix(key, m.name+":")
+	}
+	return key, true
+}
+
+// Create adds session record to the store
+func (m *Manager) create(ctx context.Context, id string, ses *Session) error {
+	ctx, end := m.trace(ctx, "store.create", id)
+	err := m.retry(ctx, func(ctx context.Context) error {
+		if cs, ok := m.store.(ContextStore); ok {
+			return cs.CreateCtx(ctx, m.key(id), ses)
+		}
+		return m.store.Create(m.key(id), ses)
+	})
+	end(err)
+	return err
+}
+
+// Read retrieves session record from the store
+func (m *Manager) read(ctx context.Context, id string) (*Session, error) {
+	var ses *Session
+	ctx, end := m.trace(ctx, "store.read", id)
+	err := m.retry(ctx, func(ctx context.Context) (err error) {
+		if cs, ok := m.store.(ContextStore); ok {
+			ses, err = cs.ReadCtx(ctx, m.key(id))
+			return
+		}
+		ses, err = m.store.Read(m.key(id))
+		return
+	})
+	end(err)
+	if err != nil {
+		return nil, err
+	}
+	return ses, nil
+}
+
+// Update runs a function on session record in the store
+func (m *Manager) update(ctx context.Context, id string, fn func(*Session)) error {
+	ctx, end := m.trace(ctx, "store.update", id)
+	err := m.retry(ctx, func(ctx context.Context) error {
+		if cs, ok := m.store.(ContextStore); ok {
+			return cs.UpdateCtx(ctx, m.key(id), fn)
+		}
+		return m.store.Update(m.key(id), fn)
+	})
+	end(err)
+	return err
+}
+
+// Remove deletes session record from the store
+func (m *Manager) remove(ctx context.Context, id string) error {
+	ctx, end := m.trace(ctx, "store.delete", id)
+	err := m.retry(ctx, func(ctx context.Context) error {
+		if cs, ok := m.store.(ContextStore); ok {
+			return cs.DeleteCtx(ctx, m.key(id))
+		}
+		return m.store.Delete(m.key(id))
+	})
+	end(err)
+	return err
+}
+
+// Trace starts span of operation on session ID when tracing is enabled
+// Returned function ends the span recording the operation error
+func (m *Manager) trace(ctx context.Context, op, id string) (context.Context, func(error)) {
+	if m.tracer == nil {
+		return ctx, untraced
+	}
+	return m.tracer(ctx, op, id)
+}
+
+// Span end of untraced operations
+func untraced(error) {}
+
+// Retry runs store operation with configured retries and linear backoff
+// ErrSessionNoRecord and ErrStoreTimeout are final and never retried
+// Returns ErrStoreUnavailable without running the operation when manager has no store
+// Stops retrying with context error once the context is done
+func (m *Manager) retry(ctx context.Context, op func(context.Context) error) (err error) {
+	if m.store == nil {
+		return ErrStoreUnavailable
+	}
+	for i := 0; ; i++ {
+		err = m.bounded(ctx, op)
+		if err == nil || err == ErrSessionNoRecord || err == ErrCodecVersion || err == ErrEmptyID || err == ErrStoreTimeout || i+1 >= m.attempts {
+			return
+		}
+		m.log("debug", "store operation retry", "attempt", i+1, "err", err)
+		pause := time.NewTimer(m.backoff * time.Duration(i+1))
+		select {
+		case <-pause.C:
+		case <-ctx.Done():
+			pause.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// Bounded runs store operation within configured timeout
+// Timed out operation keeps running in background, its result is discarded
+// Context stores get the operation context cancelled on timeout
+func (m *Manager) bounded(ctx context.Context, op func(context.Context) error) error {
+	if m.timeout <= 0 {
+		return op(ctx)
+	}
+	octx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+	res := make(chan error, 1)
+	go func() {
+		res <- op(octx)
+	}()
+	select {
+	case err := <-res:
+		return err
+	case <-octx.Done():
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		m.log("error", "store operation timed out", "timeout", m.timeout)
+		return ErrStoreTimeout
+	}
+}
+
+// Fresh returns new empty session stamped with manager clock
+func (m *Manager) fresh() *Session {
+	now := m.now()
+	return &Session{Origin: now, Tstamp: now, Data: make(map[string]interface{})}
+}
+
+// Spawn returns new session for request built by the initializer or empty
+// Missing timestamps and data map of initialized session are filled in
+// Client address and user agent are captured into metadata when enabled
+func (m *Manager) spawn(r *http.Request) *Session {
+	ses := m.fresh()
+	if m.initer != nil {
+		if ini := m.initer(r); ini != nil {
+			ini = ini.copy()
+			if ini.Origin.IsZero() {
+				ini.Origin = ses.Origin
+			}
+			if ini.Tstamp.IsZero() {
+				ini.Tstamp = ses.Tstamp
+			}
+			if ini.Data == nil {
+				ini.Data = ses.Data
+			}
+			ses = ini
+		}
+	}
+	if m.capture || m.bind != 0 {
+		if ses.Meta == nil {
+			ses.Meta = make(map[string]string)
+		}
+		ses.Meta[MetaRemoteAddr] = r.RemoteAddr
+		ses.Meta[MetaUserAgent] = r.UserAgent()
+	}
+	return ses
+}
+
+// Reports whether store interface holds a nil value
+func nilStore(s Store) bool {
+	v := reflect.ValueOf(s)
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+// Fire runs lifecycle callback of every registered hook set
+func (m *Manager) fire(ev hookev, id string) {
+	for _, h := range m.hooks {
+		var fn func(string)
+		switch ev {
+		case hookCreated:
+			fn = h.Created
+		case hookExpired:
+			fn = h.Expired
+		case hookIdled:
+			fn = h.Idled
+		case hookRenewed:
+			fn = h.Renewed
+		}
+		if fn != nil {
+			fn(id)
+		}
+	}
+}
+
+// NewCookie builds session cookie for the given ID without writing it
+// Use it to set the cookie through custom response handling
+// Max-Age is set alongside Expires so clients with skewed clocks keep the cookie for the full lifetime
+// Disabled expiry produces a browser session cookie
+func (m *Manager) NewCookie(id string) *http.Cookie {
+	jar := &http.Cookie{Name: m.name, Value: m.sign(id), Path: "/", HttpOnly: m.httpOnly, Secure: m.secure}
+	if m.expiry > 0 {
+		jar.Expires = m.now().Add(m.expiry + m.grace)
+		jar.MaxAge = int((m.expiry + m.grace) / time.Second)
+	}
+	return jar
+}
+
+// Rotated sets rotation header with the reason session ID was rotated
+func (m *Manager) rotated(w http.ResponseWriter, reason string) {
+	if m.rotHdr != "" {
+		w.Header().Set(m.rotHdr, reason)
+	}
+}
+
+// SlideCookie builds session cookie expiring when the session would idle out
+// Never outlives session absolute expiry. Disabled idle timeout keeps regular expiry
+func (m *Manager) slideCookie(id string, ses *Session) *http.Cookie {
+	jar := m.NewCookie(id)
+	idle := m.idle
+	if ses.Idle != 0 {
+		idle = ses.Idle
+	}
+	if idle <= 0 {
+		return jar
+	}
+	now := m.now()
+	exp := now.Add(idle)
+	if m.expiry > 0 {
+		if end := ses.Origin.Add(m.expiry + m.grace); end.Before(exp) {
+			exp = end
+		}
+	}
+	jar.Expires = exp
+	jar.MaxAge = int(exp.Sub(now) / time.Second)
+	if jar.MaxAge <= 0 {
+		jar.MaxAge = 1
+	}
+	return jar
+}
+
 // Put writes new cookie to response
-func (m *Manager) putCookie(w http.ResponseWriter, id string) {
-	exp := time.Now().Add(m.expiry)
-	jar := http.Cookie{Name: m.name, Value: id, Expires: exp, Path: "/", HttpOnly: true}
-	http.SetCookie(w, &jar)
+// Must only be called once the session record is persisted
+// Cookies browsers would silently drop are not written and ErrCookieTooLarge is returned
+func (m *Manager) putCookie(w http.ResponseWriter, id string) error {
+	return m.emit(w, m.NewCookie(id))
+}
+
+// Cookie returns raw session cookie value and the legacy name it was found under
+// Current cookie name takes precedence over legacy names
+func (m *Manager) cookie(r *http.Request) (string, string) {
+	if jar, err := r.Cookie(m.name); err == nil {
+		return jar.Value, ""
+	}
+	for _, name := range m.legacy {
+		if jar, err := r.Cookie(name); err == nil {
+			return jar.Value, name
+		}
+	}
+	return "", ""
+}
+
+// DropCookie writes expired cookie of given name to response
+func (m *Manager) dropCookie(w http.ResponseWriter, name string) {
+	jar := m.NewCookie("")
+	jar.Name = name
+	jar.Expires = time.Unix(0, 0)
+	jar.MaxAge = -1
+	m.writer(w, jar)
+}
+
+// Emit writes cookie to response unless it exceeds browser size limit
+func (m *Manager) emit(w http.ResponseWriter, jar *http.Cookie) error {
+	if len(jar.String()) > maxCookie {
+		m.log("error", "session cookie too large", "size", len(jar.String()))
+		return ErrCookieTooLarge
+	}
+	m.writer(w, jar)
+	return nil
+}
+
+// Default middleware error handler
+// Logs the error and responds with static 500 message leaving error details out of the response
+func (m *Manager) failed(w http.ResponseWriter, r *http.Request, err error) {
+	m.log("error", "session middleware failed", "err", err)
+	http.Error(w, "internal server error", http.StatusInternalServerError)
+}
+
+// NewContext returns a copy of parent context carrying session ID
+// Use it to call context based methods outside of the middleware
+func NewContext(parent context.Context, id string) context.Context {
+	return context.WithValue(parent, sesID, &sesref{id: id})
+}
+
+// SessionIDFromContext returns session ID carried by context
+// Reports false when the context carries no session
+func SessionIDFromContext(ctx context.Context) (string, bool) {
+	ref, err := refCtx(ctx)
+	if err != nil {
+		return "", false
+	}
+	return ref.get(), true
 }
 
 // Returns session ID from request context
 func sesCtx(r *http.Request) (string, error) {
-	ctx := r.Context().Value(sesID)
-	if ctx == nil {
-		return "", ErrSessionNilContext
+	return idCtx(r.Context())
+}
+
+// Returns session ID from context
+func idCtx(ctx context.Context) (string, error) {
+	ref, err := refCtx(ctx)
+	if err != nil {
+		return "", err
+	}
+	return ref.get(), nil
+}
+
+// Returns session reference from context
+func refCtx(ctx context.Context) (*sesref, error) {
+	ref, ok := ctx.Value(sesID).(*sesref)
+	if !ok {
+		return nil, ErrSessionNilContext
+	}
+	return ref, nil
+}
+
+// Returns writable session reference of request
+// With auto register enabled missing context registers the session from the request cookie
+func (m *Manager) wref(w http.ResponseWriter, r *http.Request) (*sesref, error) {
+	ref, err := wrCtx(r.Context())
+	if err != ErrSessionNilContext || !m.autoReg {
+		return ref, err
+	}
+	m.log("debug", "session registered without middleware")
+	id, err := m.register(w, r, false)
+	if err != nil {
+		return nil, err
+	}
+	return &sesref{id: id}, nil
+}
+
+// Returns writable session reference from context
+func wrCtx(ctx context.Context) (*sesref, error) {
+	ref, err := refCtx(ctx)
+	if err != nil {
+		return nil, err
 	}
-	return ctx.(string), nil
+	if ref.ro {
+		return nil, ErrSessionReadOnly
+	}
+	return ref, nil
+}
+
+// Get returns referenced session ID
+func (s *sesref) get() string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.id
+}
+
+// Set replaces referenced session ID
+func (s *sesref) set(id string) {
+	s.Lock()
+	s.id = id
+	s.Unlock()
 }
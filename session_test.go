@@ -5,16 +5,25 @@
 package gsession
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/dgraph-io/badger/v4"
 	"github.com/gavv/httpexpect"
 	"github.com/google/uuid"
+	"github.com/pkg/errors"
 )
 
 func TestSession(t *testing.T) {
@@ -207,3 +216,2992 @@ func TestSession(t *testing.T) {
 		os.RemoveAll("session")
 	})
 }
+
+func TestOptions(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		man := NewWithOptions(nil)
+		if man.name != defName || man.expiry != defExpiry || man.idle != defIdle || man.renew != defRenew {
+			t.Fatal("defaults are not applied")
+		}
+		if _, ok := man.store.(*MemoryStore); !ok {
+			t.Fatal("default store should be memory store")
+		}
+	})
+
+	t.Run("compose", func(t *testing.T) {
+		man := NewWithOptions(nil, WithExpiry(time.Hour), WithIdle(time.Minute), WithCookieName("sid"))
+		if man.expiry != time.Hour || man.idle != time.Minute || man.name != "sid" {
+			t.Fatal("options are not applied")
+		}
+		if man.renew != defRenew {
+			t.Fatal("omitted option should keep default")
+		}
+		man = NewWithOptions(nil, WithIdle(time.Minute), WithIdle(0), WithCookieName(""))
+		if man.idle != 0 || man.name != defName {
+			t.Fatal("later options should override earlier ones")
+		}
+	})
+
+	t.Run("new wrapper", func(t *testing.T) {
+		man := New(nil, 0, time.Minute, 0)
+		if man.expiry != defExpiry || man.idle != time.Minute || man.renew != defRenew {
+			t.Fatal("zero values should fall back to defaults")
+		}
+	})
+}
+
+func TestNewCookie(t *testing.T) {
+	man := NewWithOptions(nil, WithCookieName("sid"), WithExpiry(time.Hour))
+	id := uuid.New().String()
+	jar := man.NewCookie(id)
+	if jar.Name != "sid" || jar.Value != id || jar.Path != "/" || !jar.HttpOnly {
+		t.Fatal("cookie fields do not match configured options")
+	}
+	exp := time.Now().Add(time.Hour)
+	if jar.Expires.After(exp) || jar.Expires.Before(exp.Add(-time.Minute)) {
+		t.Fatal("cookie expiry does not match configured expiry")
+	}
+}
+
+func TestDestroy(t *testing.T) {
+	man := New(NewMemoryStore(), 0, 0, 0)
+	var id string
+	handler := man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		id, err = sesCtx(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = man.Destroy(w, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	var jar *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == man.name && c.Value == "" {
+			jar = c
+		}
+	}
+	if jar == nil {
+		t.Fatal("expiring cookie is not set")
+	}
+	if jar.MaxAge >= 0 || !jar.Expires.Before(time.Now()) {
+		t.Fatal("cookie should have a past expiry")
+	}
+	if _, err := man.store.Read(id); err != ErrSessionNoRecord {
+		t.Fatal("store record should be removed")
+	}
+}
+
+func TestContext(t *testing.T) {
+	man := New(NewMemoryStore(), 0, 0, 0)
+	id := uuid.New().String()
+	err := man.store.Create(id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := NewContext(context.Background(), id)
+
+	err = man.SetCtx(ctx, "key", "val")
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := man.GetCtx(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "val" {
+		t.Fatal("invalid session data returned")
+	}
+	err = man.DeleteCtx(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = man.GetCtx(ctx, "key"); err != ErrSessionKeyInvalid {
+		t.Fatal("deleted key should return ErrSessionKeyInvalid")
+	}
+	if _, err = man.GetCtx(context.Background(), "key"); err != ErrSessionNilContext {
+		t.Fatal("bare context should return ErrSessionNilContext")
+	}
+}
+
+func TestUseTwice(t *testing.T) {
+	store := NewMemoryStore()
+	man := New(store, 0, 0, 0)
+	handler := man.Use(man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if n := len(rec.Result().Cookies()); n != 1 {
+		t.Fatalf("expected one cookie, got %d", n)
+	}
+	if n := len(store.shelf); n != 1 {
+		t.Fatalf("expected one session, got %d", n)
+	}
+}
+
+func TestInvalidID(t *testing.T) {
+	store := NewMemoryStore()
+	man := New(store, 0, 0, 0)
+	handler := man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, val := range []string{strings.Repeat("a", 8192), "not-a-uuid", "{" + uuid.New().String() + "}"} {
+		store.shelf[val] = &Session{Origin: time.Now(), Tstamp: time.Now(), Data: make(map[string]interface{})}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: man.name, Value: val})
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		cks := rec.Result().Cookies()
+		if len(cks) != 1 || cks[0].Value == val || !(UUIDGenerator{}).Valid(cks[0].Value) {
+			t.Fatal("malformed ID should be re-issued")
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var lines []string
+	logger := func(level, msg string, kv ...interface{}) {
+		lines = append(lines, level+": "+msg)
+	}
+	man := NewWithOptions(NewMemoryStore(), WithLogger(logger))
+	handler := man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	jar := rec.Result().Cookies()[0]
+	err := man.store.Update(jar.Value, func(ses *Session) {
+		ses.Origin = time.Now().AddDate(0, 0, -3)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(jar)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	exp := []string{"info: session created", "info: session expired", "info: session created"}
+	if strings.Join(lines, "\n") != strings.Join(exp, "\n") {
+		t.Fatalf("unexpected log lines: %q", lines)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	man := New(NewMemoryStore(), 0, 0, 0)
+	rec := httptest.NewRecorder()
+	id, req, err := man.Register(rec, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cks := rec.Result().Cookies(); len(cks) != 1 || cks[0].Value != id {
+		t.Fatal("session cookie should be set")
+	}
+	err = man.Set(req, "key", "val")
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := man.Get(req, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "val" {
+		t.Fatal("invalid session data returned")
+	}
+}
+
+func TestMaxDataBytes(t *testing.T) {
+	bts, err := encGob(map[string]interface{}{"key": "val"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	man := NewWithOptions(NewMemoryStore(), WithMaxDataBytes(len(bts)))
+	id := uuid.New().String()
+	err = man.store.Create(id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := NewContext(context.Background(), id)
+
+	// Exactly at the limit
+	err = man.SetAnyCtx(ctx, "key", "val")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One byte over the limit
+	err = man.SetAnyCtx(ctx, "key", "valx")
+	if err != ErrSessionTooLarge {
+		t.Fatal("write over the limit should return ErrSessionTooLarge")
+	}
+	val, err := man.GetCtx(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "val" {
+		t.Fatal("rejected write should not change session data")
+	}
+}
+
+func TestMaxKeys(t *testing.T) {
+	man := NewWithOptions(NewMemoryStore(), WithMaxKeys(3))
+	id := uuid.New().String()
+	err := man.store.Create(id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := NewContext(context.Background(), id)
+	for _, key := range []string{"a", "b", "c"} {
+		err = man.SetCtx(ctx, key, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = man.SetCtx(ctx, "d", "d")
+	if err != ErrSessionKeyLimit {
+		t.Fatal("new key past the limit should return ErrSessionKeyLimit")
+	}
+	err = man.SetCtx(ctx, "a", "z")
+	if err != nil {
+		t.Fatal("existing key update should be allowed")
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	man := New(NewMemoryStore(), 0, 0, 0)
+	rec := httptest.NewRecorder()
+	_, req, err := man.Register(rec, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	foo := man.Namespace("foo")
+	bar := man.Namespace("bar")
+	err = foo.Set(req, "key", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bar.Set(req, "key", "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := foo.Get(req, "key"); v != "foo" {
+		t.Fatal("namespaces should not collide")
+	}
+	if v, _ := bar.Get(req, "key"); v != "bar" {
+		t.Fatal("namespaces should not collide")
+	}
+	if _, err = man.Get(req, "key"); err != ErrSessionKeyInvalid {
+		t.Fatal("namespaced key should not be visible unscoped")
+	}
+	err = foo.Delete(req, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := bar.Get(req, "key"); v != "bar" {
+		t.Fatal("delete should not affect other namespace")
+	}
+
+	err = man.Namespace("a").Set(req, "b.c", "val")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = man.Namespace("a.b").Get(req, "c"); err != ErrNamespaceInvalid {
+		t.Fatal("namespace name with separator should be rejected")
+	}
+	if err = man.Namespace("a.b").Set(req, "c", "val"); err != ErrNamespaceInvalid {
+		t.Fatal("namespace name with separator should be rejected")
+	}
+}
+
+// Store wrapper failing selected operations
+type faultStore struct {
+	Store
+	create, read, update, delete error
+}
+
+func (f *faultStore) Create(id string, ses *Session) error {
+	if f.create != nil {
+		return f.create
+	}
+	return f.Store.Create(id, ses)
+}
+
+func (f *faultStore) Read(id string) (*Session, error) {
+	if f.read != nil {
+		return nil, f.read
+	}
+	return f.Store.Read(id)
+}
+
+func (f *faultStore) Update(id string, fn func(*Session)) error {
+	if f.update != nil {
+		return f.update
+	}
+	return f.Store.Update(id, fn)
+}
+
+func (f *faultStore) Delete(id string) error {
+	if f.delete != nil {
+		return f.delete
+	}
+	return f.Store.Delete(id)
+}
+
+func TestSetMulti(t *testing.T) {
+	store := &faultStore{Store: NewMemoryStore()}
+	man := NewWithOptions(store, WithMaxKeys(3))
+	_, req, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = man.SetMulti(req, map[string]interface{}{"a": "a", "b": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := man.Get(req, "b"); v != 2 {
+		t.Fatal("all keys should be set")
+	}
+
+	// Limit violation sets none
+	err = man.SetMulti(req, map[string]interface{}{"c": "c", "d": "d"})
+	if err != ErrSessionKeyLimit {
+		t.Fatal("key limit should be enforced")
+	}
+	if _, err = man.Get(req, "c"); err != ErrSessionKeyInvalid {
+		t.Fatal("no key should be set on failure")
+	}
+
+	// Store failure sets none
+	store.update = errors.New("update failed")
+	err = man.SetMulti(req, map[string]interface{}{"c": "c"})
+	if err != store.update {
+		t.Fatal("store error should be returned")
+	}
+	store.update = nil
+	if _, err = man.Get(req, "c"); err != ErrSessionKeyInvalid {
+		t.Fatal("no key should be set on failure")
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	man := New(NewMemoryStore(), 0, 0, 0)
+	_, req, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	rounds := 100
+	wg.Add(rounds)
+	for i := 0; i < rounds; i++ {
+		go func() {
+			defer wg.Done()
+			if _, err := man.Increment(req, "cnt", 2); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	res, err := man.Increment(req, "cnt", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != rounds*2-1 {
+		t.Fatalf("expected %d, got %d", rounds*2-1, res)
+	}
+	err = man.Set(req, "str", "val")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = man.Increment(req, "str", 1); err != ErrSessionTypeMismatch {
+		t.Fatal("non numeric value should return ErrSessionTypeMismatch")
+	}
+}
+
+func TestGetStringOr(t *testing.T) {
+	store := &faultStore{Store: NewMemoryStore()}
+	man := New(store, 0, 0, 0)
+	_, req, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = man.SetMulti(req, map[string]interface{}{"str": "val", "num": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := man.GetStringOr(req, "str", "def"); err != nil || v != "val" {
+		t.Fatal("present value should be returned")
+	}
+	if v, err := man.GetStringOr(req, "none", "def"); err != nil || v != "def" {
+		t.Fatal("missing key should return default")
+	}
+	if v, err := man.GetStringOr(req, "num", "def"); err != nil || v != "def" {
+		t.Fatal("type mismatch should return default")
+	}
+	store.read = errors.New("read failed")
+	if v, err := man.GetStringOr(req, "str", "def"); err != store.read || v != "def" {
+		t.Fatal("store error should be returned")
+	}
+}
+
+func TestRegenerate(t *testing.T) {
+	man := New(NewMemoryStore(), 0, 0, 0)
+	rec := httptest.NewRecorder()
+	id, req, err := man.Register(rec, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = man.Set(req, "key", "val")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	err = man.Regenerate(rec, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cks := rec.Result().Cookies()
+	if len(cks) != 1 || cks[0].Value == id {
+		t.Fatal("new session ID should be issued")
+	}
+	if ni, _ := sesCtx(req); ni != cks[0].Value {
+		t.Fatal("request context should carry the new ID")
+	}
+	if v, err := man.Get(req, "key"); err != nil || v != "val" {
+		t.Fatal("session data should be preserved")
+	}
+	if _, err = man.store.Read(id); err != ErrSessionNoRecord {
+		t.Fatal("old session record should be removed")
+	}
+}
+
+func TestRemoveThenSet(t *testing.T) {
+	man := New(NewMemoryStore(), 0, 0, 0)
+	handler := man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := man.Set(r, "key", "old")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = man.Remove(w, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = man.Get(r, "key"); err != ErrSessionKeyInvalid {
+			t.Fatal("removed session data should be gone")
+		}
+		err = man.Set(r, "key", "new")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	cks := rec.Result().Cookies()
+	ses, err := man.store.Read(cks[len(cks)-1].Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ses.Data["key"] != "new" {
+		t.Fatal("set after remove should write to the new session")
+	}
+}
+
+func TestFailOpen(t *testing.T) {
+	for _, open := range []bool{false, true} {
+		store := &faultStore{Store: NewMemoryStore()}
+		man := NewWithOptions(store, WithFailOpen(open))
+		handler := man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		jar := rec.Result().Cookies()[0]
+
+		store.read = errors.New("read failed")
+		store.update = store.read
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(jar)
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if !open {
+			if rec.Code != http.StatusInternalServerError {
+				t.Fatal("fail closed should return error status")
+			}
+			continue
+		}
+		cks := rec.Result().Cookies()
+		if rec.Code != http.StatusOK || len(cks) != 1 || cks[0].Value == jar.Value {
+			t.Fatal("fail open should issue a fresh session")
+		}
+	}
+}
+
+// Manually advanced clock
+type fakeClock struct {
+	sync.Mutex
+	tm time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.tm
+}
+
+func (c *fakeClock) add(d time.Duration) {
+	c.Lock()
+	c.tm = c.tm.Add(d)
+	c.Unlock()
+}
+
+func TestClock(t *testing.T) {
+	clk := &fakeClock{tm: time.Now()}
+	man := NewWithOptions(NewMemoryStore(), WithClock(clk.now), WithIdle(0), WithRenew(0))
+	handler := man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	send := func(jar *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		if jar != nil {
+			req.AddCookie(jar)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	jar := send(nil).Result().Cookies()[0]
+
+	clk.add(defExpiry - time.Minute)
+	if len(send(jar).Result().Cookies()) != 0 {
+		t.Fatal("session should still be valid")
+	}
+	clk.add(time.Minute * 2)
+	cks := send(jar).Result().Cookies()
+	if len(cks) != 1 || cks[0].Value == jar.Value {
+		t.Fatal("session should expire")
+	}
+	if _, err := man.store.Read(jar.Value); err != ErrSessionNoRecord {
+		t.Fatal("expired session should be removed")
+	}
+}
+
+func TestSetIdle(t *testing.T) {
+	clk := &fakeClock{tm: time.Now()}
+	man := NewWithOptions(NewMemoryStore(), WithClock(clk.now), WithRenew(0))
+	handler := man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.RequestURI == "/admin" {
+			err := man.SetIdle(r, time.Minute*5)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}))
+	send := func(uri string, jar *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", uri, nil)
+		if jar != nil {
+			req.AddCookie(jar)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	admin := send("/admin", nil).Result().Cookies()[0]
+	user := send("/", nil).Result().Cookies()[0]
+
+	clk.add(time.Minute * 10)
+	if cks := send("/", admin).Result().Cookies(); len(cks) != 1 || cks[0].Value == admin.Value {
+		t.Fatal("short idle session should time out")
+	}
+	if len(send("/", user).Result().Cookies()) != 0 {
+		t.Fatal("default idle session should still be valid")
+	}
+}
+
+func TestDebugHeader(t *testing.T) {
+	for _, hdr := range []string{"", "X-Session-ID"} {
+		man := NewWithOptions(NewMemoryStore(), WithDebugHeader(hdr))
+		handler := man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		val := rec.Header().Get("X-Session-ID")
+		if hdr == "" && val != "" {
+			t.Fatal("debug header should not be set by default")
+		}
+		if hdr != "" && val != rec.Result().Cookies()[0].Value {
+			t.Fatal("debug header should carry session ID")
+		}
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	store := NewMemoryStore()
+	adm := NewWithOptions(store, WithCookieName("admin"), WithKeyPrefix(true))
+	pub := NewWithOptions(store, WithCookieName("public"), WithKeyPrefix(true))
+	_, req, err := adm.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = adm.Set(req, "key", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := sesCtx(req)
+	if _, err = store.Read("admin:" + id); err != nil {
+		t.Fatal("store key should be prefixed with cookie name")
+	}
+
+	// Admin session ID is unknown to the public manager
+	pr := httptest.NewRequest("GET", "/", nil)
+	pr.AddCookie(&http.Cookie{Name: "public", Value: id})
+	rec := httptest.NewRecorder()
+	pid, pr, err := pub.Register(rec, pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid == id {
+		t.Fatal("managers sharing a store should be isolated")
+	}
+	if _, err = pub.Get(pr, "key"); err != ErrSessionKeyInvalid {
+		t.Fatal("public session should not see admin data")
+	}
+	if v, _ := adm.Get(req, "key"); v != "admin" {
+		t.Fatal("admin data should be intact")
+	}
+}
+
+func TestKeyPrefixCleanup(t *testing.T) {
+	fs := NewFileStore(filepath.Join(t.TempDir(), "session"))
+	defer fs.Close()
+	for _, store := range []Store{NewMemoryStore(), fs} {
+		adm := NewWithOptions(store, WithCookieName("admin"), WithKeyPrefix(true), WithExpiry(time.Minute), WithIdle(0))
+		pub := NewWithOptions(store, WithCookieName("public"), WithKeyPrefix(true), WithExpiry(time.Hour*24), WithIdle(0))
+		old := time.Now().Add(-time.Hour)
+		store.Create("admin:old", &Session{Origin: old, Tstamp: old})
+		store.Create("public:old", &Session{Origin: old, Tstamp: old})
+		if err := adm.cleanup(adm.expiry); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Read("admin:old"); err != ErrSessionNoRecord {
+			t.Fatal("cleanup should remove own expired records")
+		}
+		if _, err := store.Read("public:old"); err != nil {
+			t.Fatal("cleanup should keep records of other managers")
+		}
+		if err := pub.cleanup(pub.expiry); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Read("public:old"); err != nil {
+			t.Fatal("cleanup should honour own expiry")
+		}
+	}
+}
+
+func TestExpiryGrace(t *testing.T) {
+	clk := &fakeClock{tm: time.Now()}
+	man := NewWithOptions(NewMemoryStore(), WithClock(clk.now), WithIdle(0), WithRenew(0), WithExpiryGrace(time.Minute*10))
+	handler := man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	send := func(jar *http.Cookie) *http.Cookie {
+		req := httptest.NewRequest("GET", "/", nil)
+		if jar != nil {
+			req.AddCookie(jar)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if cks := rec.Result().Cookies(); len(cks) > 0 {
+			return cks[0]
+		}
+		return nil
+	}
+	jar := send(nil)
+	if jar.MaxAge != int((defExpiry+time.Minute*10)/time.Second) {
+		t.Fatal("cookie Max-Age should cover expiry and grace")
+	}
+	err := man.store.Update(jar.Value, func(ses *Session) {
+		ses.Data["key"] = "val"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Within grace window session is renewed with data intact
+	clk.add(defExpiry + time.Minute*5)
+	ren := send(jar)
+	if ren == nil || ren.Value == jar.Value {
+		t.Fatal("session within grace should be renewed")
+	}
+	ses, err := man.store.Read(ren.Value)
+	if err != nil || ses.Data["key"] != "val" {
+		t.Fatal("renewed session should keep data")
+	}
+
+	// Further requests within grace window keep the renewed ID
+	for i := 0; i < 3; i++ {
+		clk.add(time.Minute)
+		if cur := send(ren); cur != nil && cur.Value != ren.Value {
+			t.Fatal("session should be renewed only once within grace")
+		}
+	}
+	if _, err = man.store.Read(ren.Value); err != nil {
+		t.Fatal("renewed session should remain stored")
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(ren)
+	_, req, err = man.Register(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = man.GetMeta(req, metaGraced); err != ErrSessionKeyInvalid {
+		t.Fatal("grace marker should not be visible")
+	}
+	if err = man.SetMeta(req, metaGraced, ""); err != ErrReservedKey {
+		t.Fatal("grace marker should not be writable")
+	}
+
+	// Past grace window session is expired
+	clk.add(time.Minute * 3)
+	exp := send(ren)
+	if exp == nil || exp.Value == ren.Value {
+		t.Fatal("session past grace should expire")
+	}
+	ses, err = man.store.Read(exp.Value)
+	if err != nil || len(ses.Data) != 0 {
+		t.Fatal("expired session should be replaced with empty one")
+	}
+}
+
+func TestMeta(t *testing.T) {
+	man := New(NewMemoryStore(), 0, 0, 0)
+	_, req, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin, tstamp, err := man.Meta(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tm := range []time.Time{origin, tstamp} {
+		if tm.IsZero() || time.Since(tm) > time.Minute {
+			t.Fatal("timestamps should be recent and non zero")
+		}
+	}
+}
+
+func TestSetWithTTL(t *testing.T) {
+	clk := &fakeClock{tm: time.Now()}
+	man := NewWithOptions(NewMemoryStore(), WithClock(clk.now))
+	id, req, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = man.SetWithTTL(req, "csrf", "token", time.Minute*10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = man.Set(req, "pref", "dark")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk.add(time.Minute * 5)
+	if v, err := man.Get(req, "csrf"); err != nil || v != "token" {
+		t.Fatal("key should be available before TTL")
+	}
+	clk.add(time.Minute * 6)
+	if _, err = man.Get(req, "csrf"); err != ErrSessionKeyInvalid {
+		t.Fatal("key should expire after TTL")
+	}
+	ses, err := man.store.Read(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ses.Data["csrf"]; ok {
+		t.Fatal("expired key should be removed")
+	}
+	if v, err := man.Get(req, "pref"); err != nil || v != "dark" {
+		t.Fatal("session and other keys should live on")
+	}
+}
+
+func TestClone(t *testing.T) {
+	man := New(NewMemoryStore(), 0, 0, 0)
+	src, req, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = man.Set(req, "key", "src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := man.Clone(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == src {
+		t.Fatal("clone should get a new ID")
+	}
+	cln := NewContext(context.Background(), id)
+	if v, _ := man.GetCtx(cln, "key"); v != "src" {
+		t.Fatal("clone should copy session data")
+	}
+	err = man.SetCtx(cln, "key", "clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = man.SetCtx(cln, "new", "clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ses, err := man.store.Read(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ses.Data["key"] != "src" || len(ses.Data) != 1 {
+		t.Fatal("clone mutations should not affect the source")
+	}
+}
+
+func TestGetBool(t *testing.T) {
+	man := New(NewMemoryStore(), 0, 0, 0)
+	_, req, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = man.SetMulti(req, map[string]interface{}{"yes": true, "no": false, "str": "true", "num": 0, "bad": []int{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := man.GetBool(req, "yes"); err != nil || !v {
+		t.Fatal("true bool should be returned")
+	}
+	if v, err := man.GetBool(req, "no"); err != nil || v {
+		t.Fatal("false bool should be returned")
+	}
+	if v, err := man.GetBool(req, "str"); err != nil || !v {
+		t.Fatal("truthy string should be true")
+	}
+	if v, err := man.GetBool(req, "num"); err != nil || v {
+		t.Fatal("zero number should be false")
+	}
+	if _, err = man.GetBool(req, "none"); err != ErrSessionKeyInvalid {
+		t.Fatal("missing key should return ErrSessionKeyInvalid")
+	}
+	if _, err = man.GetBool(req, "bad"); err != ErrSessionTypeMismatch {
+		t.Fatal("non bool value should return ErrSessionTypeMismatch")
+	}
+}
+
+func TestHttpOnly(t *testing.T) {
+	for _, on := range []bool{true, false} {
+		man := NewWithOptions(NewMemoryStore(), WithHttpOnly(on))
+		rec := httptest.NewRecorder()
+		_, _, err := man.Register(rec, httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(rec.Header().Get("Set-Cookie"), "HttpOnly") != on {
+			t.Fatalf("HttpOnly directive presence should be %v", on)
+		}
+	}
+}
+
+func TestHostPrefix(t *testing.T) {
+	man := NewWithOptions(NewMemoryStore(), WithHostPrefix(true))
+	jar := man.NewCookie(uuid.New().String())
+	if jar.Name != "__Host-gsession" || !jar.Secure || jar.Path != "/" || jar.Domain != "" {
+		t.Fatal("cookie should comply with __Host- prefix requirements")
+	}
+	man = NewWithOptions(NewMemoryStore(), WithCookieName("__Host-sid"), WithHostPrefix(true))
+	if man.name != "__Host-sid" {
+		t.Fatal("prefix should not be applied twice")
+	}
+}
+
+// Store failing the first n operations
+type flakyStore struct {
+	Store
+	sync.Mutex
+	fail  int
+	calls int
+}
+
+func (f *flakyStore) flake() error {
+	f.Lock()
+	defer f.Unlock()
+	f.calls++
+	if f.fail > 0 {
+		f.fail--
+		return errors.New("transient store error")
+	}
+	return nil
+}
+
+func (f *flakyStore) Read(id string) (*Session, error) {
+	if err := f.flake(); err != nil {
+		return nil, err
+	}
+	return f.Store.Read(id)
+}
+
+func (f *flakyStore) Update(id string, fn func(*Session)) error {
+	if err := f.flake(); err != nil {
+		return err
+	}
+	return f.Store.Update(id, fn)
+}
+
+func TestStoreRetry(t *testing.T) {
+	store := &flakyStore{Store: NewMemoryStore()}
+	man := NewWithOptions(store, WithStoreRetry(3, time.Millisecond))
+	id := uuid.New().String()
+	err := store.Store.Create(id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := NewContext(context.Background(), id)
+
+	store.fail = 1
+	err = man.SetCtx(ctx, "key", "val")
+	if err != nil || store.calls != 2 {
+		t.Fatal("transient error should succeed on the second attempt")
+	}
+	store.fail, store.calls = 5, 0
+	if _, err = man.GetCtx(ctx, "key"); err == nil || store.calls != 3 {
+		t.Fatal("retries should be bounded")
+	}
+	store.fail, store.calls = 0, 0
+	if _, err = man.GetCtx(NewContext(context.Background(), uuid.New().String()), "key"); err != ErrSessionNoRecord || store.calls != 1 {
+		t.Fatal("ErrSessionNoRecord should not be retried")
+	}
+}
+
+func TestManagerStore(t *testing.T) {
+	man := New(NewMemoryStore(), 0, 0, 0)
+	id, req, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = man.Set(req, "key", "val")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ses, err := man.Store().Read(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ses.Data["key"] != "val" {
+		t.Fatal("store should return session data")
+	}
+}
+
+// Store counting operations
+type countStore struct {
+	Store
+	ops    int64
+	writes int64
+}
+
+func (c *countStore) Create(id string, ses *Session) error {
+	atomic.AddInt64(&c.ops, 1)
+	atomic.AddInt64(&c.writes, 1)
+	return c.Store.Create(id, ses)
+}
+
+func (c *countStore) Read(id string) (*Session, error) {
+	atomic.AddInt64(&c.ops, 1)
+	return c.Store.Read(id)
+}
+
+func (c *countStore) Update(id string, fn func(*Session)) error {
+	atomic.AddInt64(&c.ops, 1)
+	atomic.AddInt64(&c.writes, 1)
+	return c.Store.Update(id, fn)
+}
+
+func (c *countStore) Delete(id string) error {
+	atomic.AddInt64(&c.ops, 1)
+	atomic.AddInt64(&c.writes, 1)
+	return c.Store.Delete(id)
+}
+
+func BenchmarkRegister(b *testing.B) {
+	store := &countStore{Store: NewMemoryStore()}
+	man := New(store, 0, 0, 0)
+	id, _, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		b.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: man.name, Value: id})
+	atomic.StoreInt64(&store.ops, 0)
+	atomic.StoreInt64(&store.writes, 0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := man.register(httptest.NewRecorder(), req, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(atomic.LoadInt64(&store.ops))/float64(b.N), "ops/req")
+	b.ReportMetric(float64(atomic.LoadInt64(&store.writes))/float64(b.N), "writes/req")
+}
+
+func TestMaxRotations(t *testing.T) {
+	clk := &fakeClock{tm: time.Now()}
+	man := NewWithOptions(NewMemoryStore(), WithClock(clk.now), WithMaxRotations(2))
+	handler := man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	jar := rec.Result().Cookies()[0]
+	err := man.store.Update(jar.Value, func(ses *Session) {
+		ses.Data["key"] = "val"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		clk.add(time.Hour * 2)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(jar)
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		jar = rec.Result().Cookies()[0]
+		ses, err := man.store.Read(jar.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i <= 2 && ses.Data["key"] != "val" {
+			t.Fatal("rotation within the limit should keep data")
+		}
+		if i == 3 && len(ses.Data) != 0 {
+			t.Fatal("rotation past the limit should clear data")
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	man := New(NewFileStore(filepath.Join(t.TempDir(), "session")), 0, 0, 0)
+	id, req, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok := "token"
+	_, err = man.Token(req, &tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = man.SetMulti(req, map[string]interface{}{"str": "val", "int": 42, "real": 1.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	org, err := man.store.Read(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bts, err := man.Export(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = man.store.Delete(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = man.Import(id, bts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ses, err := man.store.Read(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ses.Origin.Equal(org.Origin) || !ses.Tstamp.Equal(org.Tstamp) || ses.Token != tok {
+		t.Fatal("timestamps and token should round trip")
+	}
+	if !reflect.DeepEqual(ses.Data, org.Data) {
+		t.Fatalf("data should round trip, got %v", ses.Data)
+	}
+}
+
+func TestRefreshCookie(t *testing.T) {
+	for _, on := range []bool{false, true} {
+		man := NewWithOptions(NewMemoryStore(), WithRefreshCookie(on))
+		handler := man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		jar := rec.Result().Cookies()[0]
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(jar)
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		cks := rec.Result().Cookies()
+		if on && (len(cks) != 1 || cks[0].Value != jar.Value) {
+			t.Fatal("cookie should be rewritten for returning session")
+		}
+		if !on && len(cks) != 0 {
+			t.Fatal("cookie should not be rewritten by default")
+		}
+	}
+}
+
+func TestTouchBuffer(t *testing.T) {
+	clk := &fakeClock{tm: time.Now()}
+	store := &countStore{Store: NewMemoryStore()}
+	man := NewWithOptions(store, WithClock(clk.now), WithRenew(0), WithTouchBuffer(time.Hour))
+	handler := man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	send := func(jar *http.Cookie) []*http.Cookie {
+		req := httptest.NewRequest("GET", "/", nil)
+		if jar != nil {
+			req.AddCookie(jar)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Result().Cookies()
+	}
+	jar := send(nil)[0]
+	org, _ := store.Read(jar.Value)
+
+	// Activity every 50 minutes keeps the session alive from the buffer alone
+	for i := 0; i < 3; i++ {
+		clk.add(time.Minute * 50)
+		if len(send(jar)) != 0 {
+			t.Fatal("buffered activity should prevent idle timeout")
+		}
+	}
+	if ses, _ := store.Store.Read(jar.Value); !ses.Tstamp.Equal(org.Tstamp) {
+		t.Fatal("activity should not be written before flush")
+	}
+	man.flush()
+	if ses, _ := store.Store.Read(jar.Value); !ses.Tstamp.Equal(clk.now()) {
+		t.Fatal("flush should write the latest activity")
+	}
+
+	// Idle detection still works
+	clk.add(time.Minute * 61)
+	if cks := send(jar); len(cks) != 1 || cks[0].Value == jar.Value {
+		t.Fatal("session should idle out")
+	}
+}
+
+func BenchmarkRegisterBuffered(b *testing.B) {
+	store := &countStore{Store: NewMemoryStore()}
+	man := NewWithOptions(store, WithTouchBuffer(time.Hour))
+	id, _, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		b.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: man.name, Value: id})
+	atomic.StoreInt64(&store.ops, 0)
+	atomic.StoreInt64(&store.writes, 0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := man.register(httptest.NewRecorder(), req, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	man.flush()
+	b.ReportMetric(float64(atomic.LoadInt64(&store.ops))/float64(b.N), "ops/req")
+	b.ReportMetric(float64(atomic.LoadInt64(&store.writes))/float64(b.N), "writes/req")
+}
+
+func TestSigningKey(t *testing.T) {
+	clk := &fakeClock{tm: time.Now()}
+	store := &faultStore{Store: NewMemoryStore()}
+	var expired int
+	man := NewWithOptions(store, WithClock(clk.now), WithSigningKey([]byte("secret")),
+		WithHooks(Hooks{Expired: func(string) { expired++ }}))
+	handler := man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	send := func(jar *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		if jar != nil {
+			req.AddCookie(jar)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	jar := send(nil).Result().Cookies()[0]
+	id, _, _, ok := man.unsign(jar.Value)
+	if !ok || id == jar.Value {
+		t.Fatal("cookie value should be signed")
+	}
+	if cks := send(jar).Result().Cookies(); len(cks) != 0 {
+		t.Fatal("signed cookie should validate")
+	}
+
+	// Tampered signature is treated as invalid and replaced
+	bad := *jar
+	bad.Value = jar.Value[:len(jar.Value)-1] + "x"
+	if cks := send(&bad).Result().Cookies(); len(cks) != 1 {
+		t.Fatal("tampered cookie should be replaced")
+	}
+
+	// Expired cookie is rejected without reading the store
+	clk.add(defExpiry + time.Minute)
+	store.read = errors.New("read")
+	store.update = store.read
+	rec := send(jar)
+	if rec.Code != 200 || len(rec.Result().Cookies()) != 1 {
+		t.Fatal("expired cookie should be replaced without store read")
+	}
+	if expired != 1 {
+		t.Fatal("expired hook should fire")
+	}
+	if _, err := store.Store.Read(id); err != ErrSessionNoRecord {
+		t.Fatal("expired session record should be deleted")
+	}
+}
+
+func TestNilData(t *testing.T) {
+	ms := NewMemoryStore()
+	man := New(ms, 0, 0, 0)
+	id := uuid.New().String()
+	err := man.Import(id, []byte(`{"Data":null}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a store persisting the record without data map
+	ms.shelf[id].Data = nil
+	req := httptest.NewRequest("GET", "/", nil)
+	req = req.WithContext(NewContext(req.Context(), id))
+	for _, fn := range []func() error{
+		func() error { return man.Delete(req, "key") },
+		func() error { return man.Set(req, "key", "val") },
+		func() error { return man.SetAny(req, "num", 1) },
+	} {
+		if err := fn(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	val, err := man.Get(req, "key")
+	if err != nil || val != "val" {
+		t.Fatal("value should be set on record with nil data")
+	}
+}
+
+func TestCookieWriter(t *testing.T) {
+	writer := func(w http.ResponseWriter, c *http.Cookie) {
+		c.SameSite = http.SameSiteNoneMode
+		c.Secure = true
+		w.Header().Add("Set-Cookie", c.String()+"; Partitioned")
+	}
+	man := NewWithOptions(nil, WithCookieWriter(writer))
+	rec := httptest.NewRecorder()
+	id, _, err := man.Register(rec, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr := rec.Header().Get("Set-Cookie")
+	if !strings.HasSuffix(hdr, "; Partitioned") || !strings.Contains(hdr, "SameSite=None") {
+		t.Fatalf("custom writer should add attributes, got %q", hdr)
+	}
+	if cks := rec.Result().Cookies(); len(cks) != 1 || cks[0].Value != id {
+		t.Fatal("session cookie should still be readable")
+	}
+}
+
+func TestRotateEvery(t *testing.T) {
+	man := NewWithOptions(NewMemoryStore(), WithRotateEvery(3))
+	handler := man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	jar := rec.Result().Cookies()[0]
+	err := man.store.Update(jar.Value, func(ses *Session) {
+		ses.Data["key"] = "val"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 6; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(jar)
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		cks := rec.Result().Cookies()
+		if i%3 != 0 {
+			if len(cks) != 0 {
+				t.Fatalf("request %d should not rotate session ID", i)
+			}
+			continue
+		}
+		if len(cks) != 1 || cks[0].Value == jar.Value {
+			t.Fatalf("request %d should rotate session ID", i)
+		}
+		jar = cks[0]
+		ses, err := man.store.Read(jar.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ses.Data["key"] != "val" || ses.Requests != 0 {
+			t.Fatal("rotation should keep data and reset request counter")
+		}
+	}
+}
+
+func TestNullStore(t *testing.T) {
+	man := New(NewNullStore(nil), 0, 0, 0)
+	_, req, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = man.Set(req, "key", "val"); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := man.Get(req, "key"); err != nil || val != "val" {
+		t.Fatal("null store should keep writes within the request")
+	}
+
+	now := time.Now()
+	fixed := &Session{Origin: now, Tstamp: now, Data: map[string]interface{}{"user": "bob"}}
+	man = New(NewNullStore(fixed), 0, 0, 0)
+	_, req, err = man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = man.Set(req, "user", "eve"); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := man.Get(req, "user"); err != nil || val != "eve" {
+		t.Fatal("null store should keep writes over fixed session")
+	}
+	_, req, err = man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := man.Get(req, "user"); err != nil || val != "bob" {
+		t.Fatal("new session should start from fixed session")
+	}
+	if fixed.Data["user"] != "bob" {
+		t.Fatal("fixed session should not be modified")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	clk := &fakeClock{tm: time.Now()}
+	man := NewWithOptions(NewMemoryStore(), WithClock(clk.now))
+	id, req, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = man.Set(req, "key", "val"); err != nil {
+		t.Fatal(err)
+	}
+	if err = man.SetWithTTL(req, "ttl", "val", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	org, _ := man.store.Read(id)
+	clk.add(time.Minute)
+	var rsp string
+	handler := man.UseReadOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tok := "token"
+		for _, fn := range []func() error{
+			func() error { return man.Set(r, "key", "new") },
+			func() error { return man.SetAny(r, "num", 1) },
+			func() error { return man.Delete(r, "key") },
+			func() error { _, err := man.Token(r, &tok); return err },
+			func() error { return man.Regenerate(w, r) },
+		} {
+			if err := fn(); err != ErrSessionReadOnly {
+				t.Fatalf("write should be rejected, got %v", err)
+			}
+		}
+		if _, err := man.Get(r, "ttl"); err != ErrSessionKeyInvalid {
+			t.Fatalf("expired key should be invalid, got %v", err)
+		}
+		val, err := man.Get(r, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp = val.(string)
+	}))
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(man.NewCookie(id))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if rsp != "val" {
+		t.Fatal("read only session should be readable")
+	}
+	ses, _ := man.store.Read(id)
+	if !ses.Tstamp.Equal(org.Tstamp) || ses.Data["key"] != "val" {
+		t.Fatal("read only request should not change the session")
+	}
+}
+
+func TestReadOnlyNested(t *testing.T) {
+	man := New(NewMemoryStore(), 0, 0, 0)
+	var inner, outer error
+	handler := man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		man.UseReadOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			inner = man.Set(r, "key", "val")
+		})).ServeHTTP(w, r)
+		outer = man.Set(r, "key", "val")
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if inner != ErrSessionReadOnly {
+		t.Fatalf("nested read only handler should reject writes, got %v", inner)
+	}
+	if outer != nil {
+		t.Fatal("outer handler should keep write access")
+	}
+}
+
+func TestStats(t *testing.T) {
+	clk := &fakeClock{tm: time.Now()}
+	man := NewWithOptions(NewMemoryStore(), WithClock(clk.now))
+	send := func(jar *http.Cookie) *http.Cookie {
+		req := httptest.NewRequest("GET", "/", nil)
+		if jar != nil {
+			req.AddCookie(jar)
+		}
+		rec := httptest.NewRecorder()
+		if _, _, err := man.Register(rec, req); err != nil {
+			t.Fatal(err)
+		}
+		if cks := rec.Result().Cookies(); len(cks) > 0 {
+			return cks[0]
+		}
+		return jar
+	}
+	jar := send(nil)
+	send(jar)
+	clk.add(time.Minute * 40)
+	jar = send(jar)
+	clk.add(time.Minute * 90)
+	jar = send(jar)
+	clk.add(time.Hour * 25)
+	send(jar)
+	send(&http.Cookie{Name: defName, Value: uuid.New().String()})
+	send(&http.Cookie{Name: defName, Value: "bogus"})
+	exp := ManagerStats{Created: 4, Validated: 1, Expired: 1, Idled: 1, Renewed: 1, Invalid: 2}
+	if got := man.Stats(); got != exp {
+		t.Fatalf("expected %+v, got %+v", exp, got)
+	}
+}
+
+func TestIDGenerator(t *testing.T) {
+	dir := t.TempDir()
+	for _, gen := range []IDGenerator{UUIDGenerator{}, Base64IDGenerator{}} {
+		store := NewFileStore(filepath.Join(dir, fmt.Sprintf("%T", gen)))
+		man := NewWithOptions(store, WithIDGenerator(gen))
+		handler := man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := man.Set(r, "key", "val"); err != nil {
+				t.Fatal(err)
+			}
+		}))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		jar := rec.Result().Cookies()[0]
+		if !gen.Valid(jar.Value) {
+			t.Fatalf("%T: ID %q should match generator format", gen, jar.Value)
+		}
+		if _, ok := gen.(Base64IDGenerator); ok && len(jar.Value) != 22 {
+			t.Fatal("base64 ID should be 22 characters")
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(jar)
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if len(rec.Result().Cookies()) != 0 {
+			t.Fatalf("%T: returning ID should validate", gen)
+		}
+		ses, err := store.Read(jar.Value)
+		if err != nil || ses.Data["key"] != "val" {
+			t.Fatalf("%T: session should round trip through the store", gen)
+		}
+		store.shelf.Close()
+	}
+	if (Base64IDGenerator{}).Valid(uuid.New().String()) || (UUIDGenerator{}).Valid(Base64IDGenerator{}.New()) {
+		t.Fatal("generators should reject foreign formats")
+	}
+}
+
+func TestValid(t *testing.T) {
+	clk := &fakeClock{tm: time.Now()}
+	store := NewMemoryStore()
+	man := NewWithOptions(store, WithClock(clk.now), WithRenew(0))
+	rec := httptest.NewRecorder()
+	id, _, err := man.Register(rec, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jar := rec.Result().Cookies()[0]
+	valid := func(jar *http.Cookie) bool {
+		req := httptest.NewRequest("GET", "/", nil)
+		if jar != nil {
+			req.AddCookie(jar)
+		}
+		ok, err := man.Valid(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	if valid(nil) {
+		t.Fatal("missing cookie should not be valid")
+	}
+	org, _ := store.Read(id)
+	clk.add(time.Minute * 30)
+	if !valid(jar) {
+		t.Fatal("active session should be valid")
+	}
+	if ses, _ := store.Read(id); !ses.Tstamp.Equal(org.Tstamp) {
+		t.Fatal("valid check should not touch the session")
+	}
+	clk.add(time.Minute * 40)
+	if valid(jar) {
+		t.Fatal("idle session should not be valid")
+	}
+	if err := store.Update(id, func(ses *Session) { ses.Tstamp = clk.now() }); err != nil {
+		t.Fatal(err)
+	}
+	if !valid(jar) {
+		t.Fatal("touched session should be valid")
+	}
+	clk.add(time.Hour * 25)
+	if err := store.Update(id, func(ses *Session) { ses.Tstamp = clk.now() }); err != nil {
+		t.Fatal(err)
+	}
+	if valid(jar) {
+		t.Fatal("expired session should not be valid")
+	}
+	if n, _ := store.Count(); n != 1 {
+		t.Fatal("valid check should not create or remove sessions")
+	}
+}
+
+func TestUser(t *testing.T) {
+	clk := &fakeClock{tm: time.Now()}
+	man := NewWithOptions(NewMemoryStore(), WithClock(clk.now))
+	rec := httptest.NewRecorder()
+	_, req, err := man.Register(rec, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid, err := man.GetUser(req); err != nil || uid != "" {
+		t.Fatal("new session should have no user")
+	}
+	if err = man.SetUser(req, "user-1"); err != nil {
+		t.Fatal(err)
+	}
+	clk.add(time.Hour * 2)
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(rec.Result().Cookies()[0])
+	rec = httptest.NewRecorder()
+	id, req, err := man.Register(rec, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cks := rec.Result().Cookies(); len(cks) != 1 || cks[0].Value != id {
+		t.Fatal("idle session should be rotated")
+	}
+	if uid, err := man.GetUser(req); err != nil || uid != "user-1" {
+		t.Fatal("user should survive idle rotation")
+	}
+}
+
+func TestSessionsForUser(t *testing.T) {
+	stores := map[string]Store{
+		"memory": NewMemoryStore(),
+		"file":   NewFileStore(filepath.Join(t.TempDir(), "session")),
+	}
+	for name, store := range stores {
+		man := NewWithOptions(store, WithKeyPrefix(true))
+		login := func(uid string) (string, *http.Request) {
+			id, req, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = man.SetUser(req, uid); err != nil {
+				t.Fatal(err)
+			}
+			return id, req
+		}
+		want := map[string]bool{}
+		for i := 0; i < 3; i++ {
+			id, _ := login("alice")
+			want[id] = true
+		}
+		bob, _ := login("bob")
+		moved, req := login("bob")
+		if err := man.SetUser(req, "alice"); err != nil {
+			t.Fatal(err)
+		}
+		want[moved] = true
+		ids, err := man.SessionsForUser("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != len(want) {
+			t.Fatalf("%s: expected %d sessions, got %d", name, len(want), len(ids))
+		}
+		for _, id := range ids {
+			if !want[id] {
+				t.Fatalf("%s: unexpected session in user list", name)
+			}
+		}
+		if err = man.InvalidateUser("alice"); err != nil {
+			t.Fatal(err)
+		}
+		if ids, _ = man.SessionsForUser("alice"); len(ids) != 0 {
+			t.Fatalf("%s: user sessions should be invalidated", name)
+		}
+		for id := range want {
+			if _, err = man.read(context.Background(), id); err != ErrSessionNoRecord {
+				t.Fatalf("%s: invalidated session should be removed", name)
+			}
+		}
+		if ids, _ = man.SessionsForUser("bob"); len(ids) != 1 || ids[0] != bob {
+			t.Fatalf("%s: other user sessions should be kept", name)
+		}
+	}
+	stores["file"].(*FileStore).shelf.Close()
+}
+
+func TestCSRF(t *testing.T) {
+	man := New(NewMemoryStore(), 0, 0, 0)
+	_, req, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if man.CSRFValidate(req, "") {
+		t.Fatal("empty token should not validate")
+	}
+	tok, err := man.CSRFToken(req)
+	if err != nil || len(tok) < 32 {
+		t.Fatal("token should be generated")
+	}
+	if again, _ := man.CSRFToken(req); again != tok {
+		t.Fatal("token should be stable within the session")
+	}
+	if !man.CSRFValidate(req, tok) {
+		t.Fatal("matching token should validate")
+	}
+	if man.CSRFValidate(req, tok[:len(tok)-1]+"x") || man.CSRFValidate(req, "") {
+		t.Fatal("mismatched token should not validate")
+	}
+	if err = man.Regenerate(httptest.NewRecorder(), req); err != nil {
+		t.Fatal(err)
+	}
+	if man.CSRFValidate(req, tok) {
+		t.Fatal("regenerate should rotate token")
+	}
+	if rot, _ := man.CSRFToken(req); rot == tok || !man.CSRFValidate(req, rot) {
+		t.Fatal("rotated token should validate")
+	}
+}
+
+func TestCreateFailNoCookie(t *testing.T) {
+	clk := &fakeClock{tm: time.Now()}
+	store := &faultStore{Store: NewMemoryStore()}
+	man := NewWithOptions(store, WithClock(clk.now))
+	rec := httptest.NewRecorder()
+	_, req, err := man.Register(rec, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jar := rec.Result().Cookies()[0]
+	store.create = errors.New("create")
+	noCookie := func(what string, rec *httptest.ResponseRecorder, err error) {
+		if err == nil {
+			t.Fatalf("%s: create failure should be returned", what)
+		}
+		if hdr := rec.Header().Values("Set-Cookie"); len(hdr) != 0 {
+			t.Fatalf("%s: no cookie should be written, got %q", what, hdr)
+		}
+	}
+	rec = httptest.NewRecorder()
+	_, _, err = man.Register(rec, httptest.NewRequest("GET", "/", nil))
+	noCookie("create", rec, err)
+
+	rec = httptest.NewRecorder()
+	err = man.Regenerate(rec, req)
+	noCookie("regenerate", rec, err)
+
+	clk.add(time.Minute * 45)
+	ret := httptest.NewRequest("GET", "/", nil)
+	ret.AddCookie(jar)
+	rec = httptest.NewRecorder()
+	_, _, err = man.Register(rec, ret)
+	noCookie("renew", rec, err)
+	if _, err = store.Read(jar.Value); err != nil {
+		t.Fatal("failed renewal should keep the old record")
+	}
+
+	rec = httptest.NewRecorder()
+	err = man.Remove(rec, req)
+	noCookie("remove", rec, err)
+}
+
+func TestKeepAlive(t *testing.T) {
+	clk := &fakeClock{tm: time.Now()}
+	man := NewWithOptions(NewMemoryStore(), WithClock(clk.now))
+	id, _, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	org, _ := man.store.Read(id)
+	stop := man.KeepAlive(context.Background(), id, time.Millisecond*10)
+	defer stop()
+	last := org.Tstamp
+	for i := 0; i < 2; i++ {
+		clk.add(time.Minute)
+		deadline := time.Now().Add(time.Second)
+		for {
+			ses, _ := man.store.Read(id)
+			if ses.Tstamp.After(last) {
+				last = ses.Tstamp
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("keep alive should advance tstamp")
+			}
+			time.Sleep(time.Millisecond * 5)
+		}
+	}
+	stop()
+	stop()
+}
+
+type longIDs struct{}
+
+func (longIDs) New() string          { return strings.Repeat("a", 5000) }
+func (longIDs) Valid(id string) bool { return len(id) == 5000 }
+
+func TestCookieTooLarge(t *testing.T) {
+	var logged bool
+	logger := func(level, msg string, kv ...interface{}) {
+		if msg == "session cookie too large" {
+			logged = true
+		}
+	}
+	man := NewWithOptions(nil, WithIDGenerator(longIDs{}), WithLogger(logger))
+	rec := httptest.NewRecorder()
+	_, _, err := man.Register(rec, httptest.NewRequest("GET", "/", nil))
+	if err != ErrCookieTooLarge {
+		t.Fatalf("expected ErrCookieTooLarge, got %v", err)
+	}
+	if len(rec.Header().Values("Set-Cookie")) != 0 || !logged {
+		t.Fatal("oversized cookie should be logged and not written")
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	man := New(NewMemoryStore(), 0, 0, 0)
+	_, req, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key%d", i%2)
+			for j := 0; j < 50; j++ {
+				if err := man.SetAny(req, key, j); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := man.Get(req, key); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := man.Increment(req, "count", 1); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if val, _ := man.Get(req, "count"); val != 400 {
+		t.Fatalf("expected 400 increments, got %v", val)
+	}
+}
+
+func TestAutoRegister(t *testing.T) {
+	for _, on := range []bool{false, true} {
+		man := NewWithOptions(NewMemoryStore(), WithAutoRegister(on))
+		rec := httptest.NewRecorder()
+		id, req, err := man.Register(rec, httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = man.Set(req, "key", "val"); err != nil {
+			t.Fatal(err)
+		}
+		// Request without middleware applied, cookie only
+		bare := httptest.NewRequest("GET", "/", nil)
+		bare.AddCookie(rec.Result().Cookies()[0])
+		if _, err = man.Get(bare, "key"); err != ErrSessionNilContext {
+			t.Fatal("accessor without writer should return ErrSessionNilContext")
+		}
+		if !strings.Contains(err.Error(), "Manager.Use") {
+			t.Fatal("error should point to the middleware")
+		}
+		rec = httptest.NewRecorder()
+		err = man.Regenerate(rec, bare)
+		if !on {
+			if err != ErrSessionNilContext {
+				t.Fatal("strict mode should return ErrSessionNilContext")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		cks := rec.Result().Cookies()
+		ni := cks[len(cks)-1].Value
+		if ni == id {
+			t.Fatal("lenient mode should regenerate the cookie session")
+		}
+		ses, err := man.store.Read(ni)
+		if err != nil || ses.Data["key"] != "val" {
+			t.Fatal("regenerated session should keep data")
+		}
+	}
+}
+
+func TestTokenValid(t *testing.T) {
+	man := New(NewMemoryStore(), 0, 0, 0)
+	_, req, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := man.TokenValid(req, ""); err != nil || ok {
+		t.Fatal("empty session token should not match")
+	}
+	tok := "verify-123"
+	if _, err = man.Token(req, &tok); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := man.TokenValid(req, tok); err != nil || !ok {
+		t.Fatal("matching token should be valid")
+	}
+	for _, bad := range []string{"", "verify-124", "verify-1234"} {
+		if ok, _ := man.TokenValid(req, bad); ok {
+			t.Fatalf("token %q should not match", bad)
+		}
+	}
+	if _, err = man.TokenValid(httptest.NewRequest("GET", "/", nil), tok); err != ErrSessionNilContext {
+		t.Fatal("missing context should be returned")
+	}
+}
+
+func TestValidator(t *testing.T) {
+	clk := &fakeClock{tm: time.Now()}
+	var cutoff time.Time
+	man := NewWithOptions(NewMemoryStore(), WithClock(clk.now), WithValidator(func(ses *Session) bool {
+		return !ses.Origin.Before(cutoff)
+	}))
+	send := func(jar *http.Cookie) []*http.Cookie {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(jar)
+		rec := httptest.NewRecorder()
+		if _, _, err := man.Register(rec, req); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Result().Cookies()
+	}
+	rec := httptest.NewRecorder()
+	old, _, err := man.Register(rec, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jar := rec.Result().Cookies()[0]
+	clk.add(time.Minute)
+	if cks := send(jar); len(cks) != 0 {
+		t.Fatal("session after cutoff should pass")
+	}
+	cutoff = clk.now()
+	cks := send(jar)
+	if len(cks) != 1 || cks[0].Value == old {
+		t.Fatal("session before cutoff should be re-issued")
+	}
+	if _, err = man.store.Read(old); err != ErrSessionNoRecord {
+		t.Fatal("rejected session should be deleted")
+	}
+	if cks = send(cks[0]); len(cks) != 0 {
+		t.Fatal("re-issued session should pass")
+	}
+}
+
+func TestRotationHeader(t *testing.T) {
+	clk := &fakeClock{tm: time.Now()}
+	man := NewWithOptions(NewMemoryStore(), WithClock(clk.now), WithRenew(0), WithRotationHeader("X-Session-Rotated"))
+	handler := man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	send := func(jar *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		if jar != nil {
+			req.AddCookie(jar)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	rec := send(nil)
+	if rec.Header().Get("X-Session-Rotated") != "" {
+		t.Fatal("new session should not set rotation header")
+	}
+	jar := rec.Result().Cookies()[0]
+	clk.add(time.Minute * 30)
+	if rec = send(jar); rec.Header().Get("X-Session-Rotated") != "" {
+		t.Fatal("passing session should not set rotation header")
+	}
+	clk.add(time.Hour * 2)
+	if rec = send(jar); rec.Header().Get("X-Session-Rotated") != "idle" {
+		t.Fatal("idle rotation should set rotation header")
+	}
+}
+
+func TestBytes(t *testing.T) {
+	blob := make([]byte, 256)
+	for i := range blob {
+		blob[i] = byte(i)
+	}
+	stores := map[string]Store{
+		"memory": NewMemoryStore(),
+		"file":   NewFileStore(filepath.Join(t.TempDir(), "session")),
+	}
+	defer stores["file"].(*FileStore).shelf.Close()
+	for name, store := range stores {
+		man := New(store, 0, 0, 0)
+		_, req, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = man.GetBytes(req, "blob"); err != ErrSessionKeyInvalid {
+			t.Fatalf("%s: missing blob should return ErrSessionKeyInvalid", name)
+		}
+		if err = man.SetBytes(req, "blob", blob); err != nil {
+			t.Fatal(err)
+		}
+		blob[0] = 0xff
+		val, err := man.GetBytes(req, "blob")
+		if err != nil || len(val) != 256 || val[0] != 0 || val[255] != 255 {
+			t.Fatalf("%s: blob should round trip", name)
+		}
+		blob[0] = 0
+		if err = man.Delete(req, "blob"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = man.GetBytes(req, "blob"); err != ErrSessionKeyInvalid {
+			t.Fatalf("%s: deleted blob should be gone", name)
+		}
+		if err = man.SetBytes(req, "blob", blob); err != nil {
+			t.Fatal(err)
+		}
+		if err = man.SetAny(req, "blob", 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = man.GetBytes(req, "blob"); err != ErrSessionKeyInvalid {
+			t.Fatalf("%s: data value should replace blob", name)
+		}
+	}
+}
+
+func TestBytesLimit(t *testing.T) {
+	man := NewWithOptions(NewMemoryStore(), WithMaxKeys(2), WithMaxDataBytes(512))
+	_, req, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = man.SetBytes(req, "blob", make([]byte, 400)); err != nil {
+		t.Fatal(err)
+	}
+	if err = man.SetAny(req, "big", strings.Repeat("x", 400)); err != ErrSessionTooLarge {
+		t.Fatal("blobs should count towards data size limit")
+	}
+	if err = man.Set(req, "key", "val"); err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range []func() error{
+		func() error { return man.SetAny(req, "num", 1) },
+		func() error { return man.SetWithTTL(req, "num", 1, time.Hour) },
+		func() error { return man.SetMulti(req, map[string]interface{}{"num": 1}) },
+		func() error { _, err := man.Increment(req, "num", 1); return err },
+		func() error { _, err := man.CompareAndSet(req, "num", nil, 1); return err },
+	} {
+		if err := fn(); err != ErrSessionKeyLimit {
+			t.Fatalf("blobs should count towards key limit, got %v", err)
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	clk := &fakeClock{tm: time.Now()}
+	man := NewWithOptions(NewMemoryStore(), WithClock(clk.now), WithRenew(0))
+	rec := httptest.NewRecorder()
+	man.Ping(rec, httptest.NewRequest("GET", "/ping", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+	jar := rec.Result().Cookies()[0]
+	for i := 0; i < 5; i++ {
+		clk.add(time.Minute * 50)
+		req := httptest.NewRequest("GET", "/ping", nil)
+		req.AddCookie(jar)
+		rec = httptest.NewRecorder()
+		man.Ping(rec, req)
+		if rec.Code != http.StatusNoContent || len(rec.Result().Cookies()) != 0 {
+			t.Fatal("pinged session should not idle out")
+		}
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	store := &faultStore{Store: NewMemoryStore(), create: errors.New("badger: /var/lib/session: read only")}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	rec := httptest.NewRecorder()
+	New(store, 0, 0, 0).Use(next).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != 500 {
+		t.Fatal("default handler should respond with 500")
+	}
+
+	var got error
+	man := NewWithOptions(store, WithErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+		got = err
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	rec = httptest.NewRecorder()
+	man.Use(next).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable || got != store.create {
+		t.Fatal("custom error handler should be invoked with the error")
+	}
+}
+
+func TestErrorNotLeaked(t *testing.T) {
+	var logged []interface{}
+	logger := func(level, msg string, kv ...interface{}) {
+		if msg == "session middleware failed" {
+			logged = kv
+		}
+	}
+	cause := errors.New("badger: /var/lib/session: read only")
+	store := &faultStore{Store: NewMemoryStore(), create: cause}
+	man := NewWithOptions(store, WithLogger(logger))
+	rec := httptest.NewRecorder()
+	man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	body := rec.Body.String()
+	if strings.Contains(body, "badger") || strings.Contains(body, "/var/lib") {
+		t.Fatalf("response should not contain error text, got %q", body)
+	}
+	if strings.TrimSpace(body) != "internal server error" {
+		t.Fatalf("unexpected response body %q", body)
+	}
+	if len(logged) != 2 || logged[1] != cause {
+		t.Fatal("real error should be logged")
+	}
+}
+
+func TestSessionMeta(t *testing.T) {
+	man := NewWithOptions(NewMemoryStore(), WithClientMeta(true))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", "test-agent/1.0")
+	req.RemoteAddr = "192.0.2.1:1234"
+	id, req, err := man.Register(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ua, err := man.GetMeta(req, MetaUserAgent); err != nil || ua != "test-agent/1.0" {
+		t.Fatal("user agent should be captured on create")
+	}
+	if addr, err := man.GetMeta(req, MetaRemoteAddr); err != nil || addr != "192.0.2.1:1234" {
+		t.Fatal("remote address should be captured on create")
+	}
+	if _, err = man.GetMeta(req, "device"); err != ErrSessionKeyInvalid {
+		t.Fatal("missing meta key should return ErrSessionKeyInvalid")
+	}
+	if err = man.SetMeta(req, "device", "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	if dev, err := man.GetMeta(req, "device"); err != nil || dev != "laptop" {
+		t.Fatal("meta value should be set")
+	}
+	if ses, _ := man.store.Read(id); len(ses.Data) != 0 {
+		t.Fatal("meta should be kept apart from data")
+	}
+
+	man = New(NewMemoryStore(), 0, 0, 0)
+	_, req, err = man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = man.GetMeta(req, MetaUserAgent); err != ErrSessionKeyInvalid {
+		t.Fatal("client meta should not be captured by default")
+	}
+}
+
+func TestBindToClient(t *testing.T) {
+	for _, b := range []Binding{BindIP, BindUserAgent, BindBoth} {
+		man := NewWithOptions(NewMemoryStore(), WithBindToClient(b))
+		send := func(jar *http.Cookie, addr, ua string) []*http.Cookie {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = addr
+			req.Header.Set("User-Agent", ua)
+			if jar != nil {
+				req.AddCookie(jar)
+			}
+			rec := httptest.NewRecorder()
+			if _, _, err := man.Register(rec, req); err != nil {
+				t.Fatal(err)
+			}
+			return rec.Result().Cookies()
+		}
+		jar := send(nil, "192.0.2.1:1000", "agent/1")[0]
+		if cks := send(jar, "192.0.2.1:2000", "agent/1"); len(cks) != 0 {
+			t.Fatalf("binding %d: matching fingerprint should pass", b)
+		}
+		cks := send(jar, "192.0.2.1:3000", "agent/2")
+		if b&BindUserAgent != 0 {
+			if len(cks) != 1 || cks[0].Value == jar.Value {
+				t.Fatalf("binding %d: changed user agent should be rejected", b)
+			}
+			if _, err := man.store.Read(jar.Value); err != ErrSessionNoRecord {
+				t.Fatalf("binding %d: rejected session should be deleted", b)
+			}
+			continue
+		}
+		if len(cks) != 0 {
+			t.Fatalf("binding %d: user agent should not be compared", b)
+		}
+		if cks = send(jar, "198.51.100.7:1000", "agent/1"); len(cks) != 1 {
+			t.Fatalf("binding %d: changed address should be rejected", b)
+		}
+	}
+}
+
+type gateStore struct {
+	Store
+	gate chan struct{}
+	done chan struct{}
+}
+
+func (g *gateStore) Update(id string, fn func(*Session)) error {
+	<-g.gate
+	err := g.Store.Update(id, fn)
+	g.done <- struct{}{}
+	return err
+}
+
+func TestAsyncWrites(t *testing.T) {
+	clk := &fakeClock{tm: time.Now()}
+	store := &gateStore{Store: NewMemoryStore(), gate: make(chan struct{}), done: make(chan struct{}, 1)}
+	man := NewWithOptions(store, WithClock(clk.now), WithAsyncWrites(true))
+	rec := httptest.NewRecorder()
+	id, _, err := man.Register(rec, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	org, _ := store.Read(id)
+	clk.add(time.Minute)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(rec.Result().Cookies()[0])
+	ret := make(chan error)
+	go func() {
+		_, _, err := man.Register(httptest.NewRecorder(), req)
+		ret <- err
+	}()
+	select {
+	case err = <-ret:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("register should not wait for the touch write")
+	}
+	if ses, _ := store.Read(id); !ses.Tstamp.Equal(org.Tstamp) {
+		t.Fatal("touch should not be written yet")
+	}
+	close(store.gate)
+	<-store.done
+	if ses, _ := store.Read(id); !ses.Tstamp.After(org.Tstamp) {
+		t.Fatal("touch should be persisted eventually")
+	}
+}
+
+func BenchmarkRegisterReturning(b *testing.B) {
+	run := func(b *testing.B, fn func(man *Manager, req *http.Request) error) {
+		store := &countStore{Store: NewMemoryStore()}
+		man := New(store, 0, 0, 0)
+		id, r, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err = man.SetMulti(r, map[string]interface{}{"user": "bob", "role": "admin", "n": 1}); err != nil {
+			b.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: man.name, Value: id})
+		atomic.StoreInt64(&store.ops, 0)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := fn(man, req); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(atomic.LoadInt64(&store.ops))/float64(b.N), "ops/req")
+	}
+	// Separate read and timestamp update, the flow before the combined touch
+	b.Run("read+update", func(b *testing.B) {
+		run(b, func(man *Manager, req *http.Request) error {
+			jar, _ := req.Cookie(man.name)
+			val, _, err := man.validate(context.Background(), jar.Value)
+			if err != nil || val != sesPass {
+				return errors.New("session should pass")
+			}
+			return man.update(context.Background(), jar.Value, func(ses *Session) { ses.Tstamp = man.now() })
+		})
+	})
+	b.Run("touch", func(b *testing.B) {
+		run(b, func(man *Manager, req *http.Request) error {
+			_, err := man.register(httptest.NewRecorder(), req, false)
+			return err
+		})
+	})
+}
+
+func TestRegisterReturning(t *testing.T) {
+	clk := &fakeClock{tm: time.Now()}
+	man := NewWithOptions(NewMemoryStore(), WithClock(clk.now))
+	rec := httptest.NewRecorder()
+	id, r, err := man.Register(rec, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = man.Set(r, "key", "val"); err != nil {
+		t.Fatal(err)
+	}
+	jar := rec.Result().Cookies()[0]
+	send := func() (string, []*http.Cookie) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(jar)
+		rec := httptest.NewRecorder()
+		id, _, err := man.Register(rec, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id, rec.Result().Cookies()
+	}
+	clk.add(time.Minute * 10)
+	if got, cks := send(); got != id || len(cks) != 0 {
+		t.Fatal("returning session should pass without cookie")
+	}
+	ses, _ := man.store.Read(id)
+	if !ses.Tstamp.Equal(clk.now()) || ses.Data["key"] != "val" {
+		t.Fatal("pass should bump tstamp and keep data")
+	}
+	clk.add(time.Minute * 40)
+	got, cks := send()
+	if got == id || len(cks) != 1 {
+		t.Fatal("session past renew timeout should be renewed")
+	}
+	if ses, _ = man.store.Read(got); ses.Data["key"] != "val" {
+		t.Fatal("renewed session should keep data")
+	}
+}
+
+func TestSigningKeys(t *testing.T) {
+	old := NewWithOptions(NewMemoryStore(), WithSigningKey([]byte("old")))
+	rec := httptest.NewRecorder()
+	id, _, err := old.Register(rec, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jar := rec.Result().Cookies()[0]
+
+	man := NewWithOptions(old.store, WithSigningKeys([]byte("new"), []byte("old")))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(jar)
+	rec = httptest.NewRecorder()
+	got, _, err := man.Register(rec, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != id {
+		t.Fatal("cookie signed with previous key should be accepted")
+	}
+	cks := rec.Result().Cookies()
+	if len(cks) != 1 || cks[0].Value == jar.Value {
+		t.Fatal("cookie signed with previous key should be re-signed")
+	}
+	if _, _, prev, ok := man.unsign(cks[0].Value); !ok || prev {
+		t.Fatal("re-signed cookie should use current key")
+	}
+	if _, _, _, ok := old.unsign(cks[0].Value); ok {
+		t.Fatal("re-signed cookie should not verify with previous key alone")
+	}
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cks[0])
+	rec = httptest.NewRecorder()
+	if got, _, err = man.Register(rec, req); err != nil || got != id || len(rec.Result().Cookies()) != 0 {
+		t.Fatal("current key cookie should pass without re-signing")
+	}
+}
+
+func TestWrapFunc(t *testing.T) {
+	man := New(NewMemoryStore(), 0, 0, 0)
+	var val interface{}
+	handler := man.WrapFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := man.Set(r, "key", "val"); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		val, err = man.Get(r, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/", nil))
+	if val != "val" || len(rec.Result().Cookies()) != 1 {
+		t.Fatal("wrapped function should receive session context")
+	}
+}
+
+func TestNilStore(t *testing.T) {
+	var fs *FileStore
+	man := NewWithOptions(fs, WithCookieName("sid"))
+	rec := httptest.NewRecorder()
+	if _, _, err := man.Register(rec, httptest.NewRequest("GET", "/", nil)); err != ErrStoreUnavailable {
+		t.Fatalf("expected ErrStoreUnavailable, got %v", err)
+	}
+	if len(rec.Result().Cookies()) != 0 {
+		t.Fatal("no cookie should be written without store")
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req = req.WithContext(NewContext(req.Context(), uuid.New().String()))
+	if err := man.Set(req, "key", "val"); err != ErrStoreUnavailable {
+		t.Fatal("accessors should return ErrStoreUnavailable")
+	}
+	if _, err := man.Get(req, "key"); err != ErrStoreUnavailable {
+		t.Fatal("accessors should return ErrStoreUnavailable")
+	}
+	if _, err := man.SessionsForUser("bob"); err != ErrStoreUnavailable {
+		t.Fatal("user lookup should return ErrStoreUnavailable")
+	}
+	if err := man.InvalidateUser("bob"); err != ErrStoreUnavailable {
+		t.Fatal("user invalidation should return ErrStoreUnavailable")
+	}
+	if _, err := man.Dump(); err != ErrStoreUnavailable {
+		t.Fatal("dump should return ErrStoreUnavailable")
+	}
+	rec = httptest.NewRecorder()
+	man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != 500 {
+		t.Fatal("middleware should fail without panic")
+	}
+}
+
+func TestCleanupIdle(t *testing.T) {
+	store := NewMemoryStore()
+	man := NewWithOptions(store, WithExpiry(0), WithTouchBuffer(time.Hour))
+	now := time.Now()
+	store.Create("idle", &Session{Origin: now, Tstamp: now.Add(-time.Hour * 2)})
+	store.Create("fresh", &Session{Origin: now, Tstamp: now})
+	store.Create("buffered", &Session{Origin: now, Tstamp: now.Add(-time.Hour * 2)})
+	man.touches.tstamps["buffered"] = now
+	if err := man.cleanup(man.expiry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Read("idle"); err != ErrSessionNoRecord {
+		t.Fatal("cleanup should remove idle records")
+	}
+	for _, id := range []string{"fresh", "buffered"} {
+		if _, err := store.Read(id); err != nil {
+			t.Fatalf("cleanup should keep %s record", id)
+		}
+	}
+}
+
+func TestCleanupGrace(t *testing.T) {
+	store := NewMemoryStore()
+	man := NewWithOptions(store, WithExpiry(time.Hour), WithIdle(0), WithExpiryGrace(time.Minute*10))
+	now := time.Now()
+	store.Create("graced", &Session{Origin: now.Add(-time.Hour - time.Minute*5), Tstamp: now})
+	store.Create("expired", &Session{Origin: now.Add(-time.Hour - time.Minute*20), Tstamp: now})
+	if err := man.cleanup(man.expiry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Read("graced"); err != nil {
+		t.Fatal("cleanup should keep records within grace window")
+	}
+	if _, err := store.Read("expired"); err != ErrSessionNoRecord {
+		t.Fatal("cleanup should remove records past grace window")
+	}
+}
+
+func TestSlidingCookie(t *testing.T) {
+	clk := &fakeClock{tm: time.Now()}
+	man := NewWithOptions(NewMemoryStore(), WithClock(clk.now), WithRenew(0), WithSlidingCookie(true))
+	handler := man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	jar := rec.Result().Cookies()[0]
+	last := clk.now()
+	for i := 0; i < 3; i++ {
+		clk.add(time.Minute * 30)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(jar)
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		cks := rec.Result().Cookies()
+		if len(cks) != 1 || cks[0].Value != jar.Value {
+			t.Fatal("passing request should re-emit the cookie")
+		}
+		exp := cks[0].Expires
+		if !exp.After(last) || exp.Sub(clk.now()) > defIdle || cks[0].MaxAge != int(defIdle/time.Second) {
+			t.Fatalf("cookie expiry should slide with idle timeout, got %v", exp)
+		}
+		last = exp
+	}
+	// Near absolute expiry the cookie is capped at session end
+	clk.add(defExpiry - time.Minute*100)
+	if err := man.store.Update(jar.Value, func(ses *Session) { ses.Tstamp = clk.now() }); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(jar)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if cks := rec.Result().Cookies(); len(cks) != 1 || cks[0].MaxAge != int(time.Minute*10/time.Second) {
+		t.Fatal("sliding cookie should not outlive absolute expiry")
+	}
+}
+
+func TestSessionIDFromContext(t *testing.T) {
+	if _, ok := SessionIDFromContext(context.Background()); ok {
+		t.Fatal("bare context should carry no session")
+	}
+	if _, ok := SessionIDFromContext(context.WithValue(context.Background(), ContextKey(0), "x")); ok {
+		t.Fatal("foreign value under the key should be ignored")
+	}
+	man := New(NewMemoryStore(), 0, 0, 0)
+	var got string
+	handler := man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = SessionIDFromContext(r.Context())
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if got == "" || got != rec.Result().Cookies()[0].Value {
+		t.Fatal("session ID should be read from context")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	clk := &fakeClock{tm: time.Now()}
+	store := NewMemoryStore()
+	man := NewWithOptions(store, WithClock(clk.now), WithRenew(0), WithTouchBuffer(time.Hour))
+	handler := man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	jar := rec.Result().Cookies()[0]
+
+	clk.add(time.Minute)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(jar)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if ses, _ := store.Read(jar.Value); ses.Tstamp.Equal(clk.now()) {
+		t.Fatal("activity should be buffered")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := man.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ses, _ := store.Read(jar.Value); !ses.Tstamp.Equal(clk.now()) {
+		t.Fatal("shutdown should flush buffered activity")
+	}
+	if err := man.Shutdown(ctx); err != nil {
+		t.Fatal("repeated shutdown should succeed")
+	}
+}
+
+func TestShutdownSharedStore(t *testing.T) {
+	fs := NewFileStore(filepath.Join(t.TempDir(), "session"))
+	defer fs.Close()
+	m1 := NewWithOptions(fs, WithAsyncWrites(true))
+	m2 := NewWithOptions(fs)
+	if err := m1.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m2.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Fatalf("shared store should stay open after shutdown, got %v", err)
+	}
+}
+
+func TestPingStore(t *testing.T) {
+	fs := NewFileStore(filepath.Join(t.TempDir(), "session"))
+	man := NewWithOptions(fs)
+	if err := man.PingStore(); err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+	if err := man.PingStore(); err == nil {
+		t.Fatal("closed store should fail ping")
+	}
+	var nilStore *FileStore
+	if err := NewWithOptions(nilStore).PingStore(); err != ErrStoreUnavailable {
+		t.Fatal("nil store should return ErrStoreUnavailable")
+	}
+}
+
+func TestReservedKey(t *testing.T) {
+	man := New(NewMemoryStore(), 0, 0, 0)
+	_, req, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := man.CSRFToken(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = man.Set(req, csrfKey, "forged"); err != ErrReservedKey {
+		t.Fatal("reserved key should be rejected by Set")
+	}
+	if err = man.SetAny(req, ReservedPrefix+"user", 1); err != ErrReservedKey {
+		t.Fatal("reserved key should be rejected by SetAny")
+	}
+	if err = man.SetMulti(req, map[string]interface{}{"key": "val", csrfKey: "forged"}); err != ErrReservedKey {
+		t.Fatal("reserved key should be rejected by SetMulti")
+	}
+	if _, err = man.Increment(req, csrfKey, 1); err != ErrReservedKey {
+		t.Fatal("reserved key should be rejected by Increment")
+	}
+	if err = man.SetBytes(req, csrfKey, []byte("forged")); err != ErrReservedKey {
+		t.Fatal("reserved key should be rejected by SetBytes")
+	}
+	if !man.CSRFValidate(req, tok) {
+		t.Fatal("internal state should be intact")
+	}
+	if err = man.Set(req, "gs.key", "val"); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := man.Get(req, "gs.key"); val != "val" {
+		t.Fatal("normal key should be set")
+	}
+}
+
+func TestLegacyCookieNames(t *testing.T) {
+	store := NewMemoryStore()
+	old := NewWithOptions(store, WithCookieName("sid"))
+	rec := httptest.NewRecorder()
+	old.Register(rec, httptest.NewRequest("GET", "/", nil))
+	legacy := rec.Result().Cookies()[0]
+
+	man := NewWithOptions(store, WithLegacyCookieNames("sid"))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(legacy)
+	rec = httptest.NewRecorder()
+	id, _, err := man.Register(rec, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != legacy.Value {
+		t.Fatal("legacy session should be adopted")
+	}
+	jars := map[string]*http.Cookie{}
+	for _, jar := range rec.Result().Cookies() {
+		jars[jar.Name] = jar
+	}
+	if jar := jars["gsession"]; jar == nil || jar.Value != legacy.Value {
+		t.Fatal("session should be reissued under the current name")
+	}
+	if jar := jars["sid"]; jar == nil || jar.MaxAge >= 0 {
+		t.Fatal("legacy cookie should be expired")
+	}
+}
+
+func TestCodecVersionReissue(t *testing.T) {
+	fs := NewFileStore(filepath.Join(t.TempDir(), "session"))
+	defer fs.shelf.Close()
+	man := NewWithOptions(fs)
+	rec := httptest.NewRecorder()
+	man.Register(rec, httptest.NewRequest("GET", "/", nil))
+	jar := rec.Result().Cookies()[0]
+	err := fs.shelf.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(jar.Value), []byte{gobVersion + 1, 0})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(jar)
+	rec = httptest.NewRecorder()
+	id, _, err := man.Register(rec, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == jar.Value || len(rec.Result().Cookies()) != 1 {
+		t.Fatal("session of unknown record version should be reissued")
+	}
+	if _, err = fs.Read(jar.Value); err != ErrCodecVersion {
+		t.Fatal("record of unknown version should be kept")
+	}
+	if err = fs.Expire(time.Nanosecond); err != nil {
+		t.Fatal("expiry should skip records of unknown version")
+	}
+}
+
+// Store honoring context cancellation
+type ctxStore struct {
+	Store
+	calls int
+}
+
+func (s *ctxStore) CreateCtx(ctx context.Context, id string, ses *Session) error {
+	s.calls++
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Store.Create(id, ses)
+}
+
+func (s *ctxStore) ReadCtx(ctx context.Context, id string) (*Session, error) {
+	s.calls++
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Store.Read(id)
+}
+
+func (s *ctxStore) UpdateCtx(ctx context.Context, id string, fn func(*Session)) error {
+	s.calls++
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Store.Update(id, fn)
+}
+
+func (s *ctxStore) DeleteCtx(ctx context.Context, id string) error {
+	s.calls++
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Store.Delete(id)
+}
+
+func TestContextStore(t *testing.T) {
+	store := &ctxStore{Store: NewMemoryStore()}
+	man := NewWithOptions(store, WithStoreRetry(3, time.Hour))
+	rec := httptest.NewRecorder()
+	_, req, err := man.Register(rec, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.calls == 0 {
+		t.Fatal("context variants should be used")
+	}
+	if err = man.Set(req, "key", "val"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	cancel()
+	if err = man.SetCtx(ctx, "key", "new"); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	dead := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	dead.AddCookie(rec.Result().Cookies()[0])
+	if _, _, err = man.Register(httptest.NewRecorder(), dead); err != context.Canceled {
+		t.Fatal("cancelled request should abort validation without retry backoff")
+	}
+	if val, _ := man.Get(req, "key"); val != "val" {
+		t.Fatal("cancelled write should not change the session")
+	}
+}
+
+// Store blocking record access until released
+type slowStore struct {
+	Store
+	gate chan struct{}
+}
+
+func (s *slowStore) Update(id string, fn func(*Session)) error {
+	<-s.gate
+	return s.Store.Update(id, fn)
+}
+
+func TestStoreTimeout(t *testing.T) {
+	store := &slowStore{Store: NewMemoryStore(), gate: make(chan struct{})}
+	defer close(store.gate)
+	man := NewWithOptions(store, WithStoreTimeout(time.Millisecond*50), WithStoreRetry(3, time.Hour))
+	rec := httptest.NewRecorder()
+	if _, _, err := man.Register(rec, httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(rec.Result().Cookies()[0])
+	start := time.Now()
+	if _, _, err := man.Register(httptest.NewRecorder(), req); err != ErrStoreTimeout {
+		t.Fatalf("expected ErrStoreTimeout, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("timed out operation should not be retried")
+	}
+}
+
+func TestTime(t *testing.T) {
+	dir := t.TempDir()
+	stores := map[string]Store{
+		"gob":  NewFileStore(filepath.Join(dir, "gob")),
+		"json": NewFileStore(filepath.Join(dir, "json"), StoreCodec(JSONCodec{})),
+	}
+	for _, st := range stores {
+		defer st.(*FileStore).shelf.Close()
+	}
+	tm := time.Date(2024, 3, 9, 14, 30, 15, 123456789, time.FixedZone("X", 3600))
+	for name, store := range stores {
+		man := NewWithOptions(store)
+		_, req, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = man.SetTime(req, "seen", tm); err != nil {
+			t.Fatal(err)
+		}
+		res, err := man.GetTime(req, "seen")
+		if err != nil || !res.Equal(tm) {
+			t.Fatalf("%s: time should round trip, got %v %v", name, res, err)
+		}
+		man.Set(req, "name", "val")
+		if _, err = man.GetTime(req, "name"); err != ErrSessionTypeMismatch {
+			t.Fatalf("%s: non time value should return ErrSessionTypeMismatch", name)
+		}
+	}
+}
+
+func TestUntracked(t *testing.T) {
+	store := &countStore{Store: NewMemoryStore()}
+	man := NewWithOptions(store, WithIdle(0), WithRenew(0))
+	rec := httptest.NewRecorder()
+	_, req, err := man.Register(rec, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jar := rec.Result().Cookies()[0]
+	atomic.StoreInt64(&store.writes, 0)
+	for i := 0; i < 3; i++ {
+		req = httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(jar)
+		if id, _, err := man.Register(httptest.NewRecorder(), req); err != nil || id != jar.Value {
+			t.Fatal("returning request should pass")
+		}
+	}
+	if n := atomic.LoadInt64(&store.writes); n != 0 {
+		t.Fatalf("expected no store writes, got %d", n)
+	}
+
+	// Records with own idle timeout are still tracked
+	_, req, _ = man.Register(httptest.NewRecorder(), req)
+	if err = man.SetIdle(req, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt64(&store.writes, 0)
+	man.Register(httptest.NewRecorder(), req)
+	if n := atomic.LoadInt64(&store.writes); n != 1 {
+		t.Fatalf("record with own idle timeout should be touched, got %d writes", n)
+	}
+}
+
+func TestSessionInitializer(t *testing.T) {
+	man := NewWithOptions(NewMemoryStore(), WithSessionInitializer(func(r *http.Request) *Session {
+		if r.Header.Get("Theme") == "" {
+			return nil
+		}
+		return &Session{Data: map[string]interface{}{"theme": r.Header.Get("Theme")}}
+	}))
+	var got interface{}
+	var gerr error
+	handler := man.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, gerr = man.Get(r, "theme")
+	}))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Theme", "dark")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if gerr != nil || got != "dark" {
+		t.Fatal("seeded value should be readable on the first request")
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if gerr != ErrSessionKeyInvalid {
+		t.Fatal("nil initializer result should create empty session")
+	}
+}
+
+func TestRemainingLifetime(t *testing.T) {
+	clk := &fakeClock{tm: time.Now()}
+	man := NewWithOptions(NewMemoryStore(), WithClock(clk.now), WithExpiry(time.Hour), WithExpiryGrace(time.Minute), WithIdle(time.Minute*30), WithRenew(0))
+	_, req, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left, _ := man.ExpiresIn(req); left != time.Minute*61 {
+		t.Fatalf("unexpected expiry %v", left)
+	}
+	if left, _ := man.IdleRemaining(req); left != time.Minute*30 {
+		t.Fatalf("unexpected idle remaining %v", left)
+	}
+	clk.add(time.Minute * 20)
+	if left, _ := man.ExpiresIn(req); left != time.Minute*41 {
+		t.Fatalf("expiry should decrease, got %v", left)
+	}
+	if left, _ := man.IdleRemaining(req); left != time.Minute*10 {
+		t.Fatalf("idle remaining should decrease, got %v", left)
+	}
+	clk.add(time.Minute * 20)
+	if left, _ := man.IdleRemaining(req); left != 0 {
+		t.Fatal("idle remaining should stop at zero")
+	}
+	man.SetIdle(req, -1)
+	if left, _ := man.IdleRemaining(req); left != -1 {
+		t.Fatal("disabled idle timeout should return -1")
+	}
+}
+
+// Store holding deletions long enough for concurrent callers to pile up
+type lagStore struct {
+	Store
+}
+
+func (s *lagStore) Delete(id string) error {
+	time.Sleep(time.Millisecond * 50)
+	return s.Store.Delete(id)
+}
+
+func TestConcurrentRemove(t *testing.T) {
+	store := NewMemoryStore()
+	man := NewWithOptions(&lagStore{Store: store})
+	rec := httptest.NewRecorder()
+	old, _, err := man.Register(rec, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const num = 16
+	ids := make([]string, num)
+	var wg sync.WaitGroup
+	for i := 0; i < num; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest("GET", "/", nil)
+			req = req.WithContext(NewContext(req.Context(), old))
+			rec := httptest.NewRecorder()
+			if err := man.Remove(rec, req); err != nil {
+				t.Error(err)
+				return
+			}
+			ids[i] = rec.Result().Cookies()[0].Value
+		}(i)
+	}
+	wg.Wait()
+	for _, id := range ids {
+		if id != ids[0] {
+			t.Fatal("concurrent removals should share the replacement session")
+		}
+	}
+	if num, _ := store.Count(); num != 1 {
+		t.Fatalf("expected a single record, got %d", num)
+	}
+	if _, err := store.Read(old); err != ErrSessionNoRecord {
+		t.Fatal("removed session should be gone")
+	}
+	if len(man.removals) != 0 {
+		t.Fatal("finished removals should be forgotten")
+	}
+}
+
+// Store rerunning update functions after a conflicting write as optimistic stores do
+type replayStore struct {
+	Store
+	meddle func(*Session)
+}
+
+func (s *replayStore) Update(id string, fn func(*Session)) error {
+	if s.meddle != nil {
+		ses, err := s.Store.Read(id)
+		if err != nil {
+			return err
+		}
+		fn(ses.copy())
+		err = s.Store.Update(id, s.meddle)
+		if err != nil {
+			return err
+		}
+	}
+	return s.Store.Update(id, fn)
+}
+
+func TestCompareAndSet(t *testing.T) {
+	man := New(NewMemoryStore(), 0, 0, 0)
+	_, req, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := man.CompareAndSet(req, "ver", nil, 1); err != nil || !ok {
+		t.Fatal("missing key should match nil")
+	}
+	if ok, err := man.CompareAndSet(req, "ver", 1, 2); err != nil || !ok {
+		t.Fatal("matching value should be swapped")
+	}
+	if ok, err := man.CompareAndSet(req, "ver", 1, 3); err != nil || ok {
+		t.Fatal("stale value should not be swapped")
+	}
+	if val, _ := man.Get(req, "ver"); val != 2 {
+		t.Fatalf("unexpected value %v", val)
+	}
+	if ok, _ := man.CompareAndSet(req, "missing", "val", "new"); ok {
+		t.Fatal("missing key should not match non nil value")
+	}
+	if _, err := man.Get(req, "missing"); err != ErrSessionKeyInvalid {
+		t.Fatal("failed swap should not set the key")
+	}
+
+	// Rerun after a conflicting write reports the outcome of the last run
+	store := &replayStore{Store: NewMemoryStore()}
+	man = New(store, 0, 0, 0)
+	_, req, err = man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = man.SetAny(req, "ver", 1); err != nil {
+		t.Fatal(err)
+	}
+	store.meddle = func(ses *Session) { ses.Data["ver"] = "other" }
+	if ok, err := man.CompareAndSet(req, "ver", 1, 2); err != nil || ok {
+		t.Fatal("swap overtaken by conflicting write should not be reported")
+	}
+	store.meddle = nil
+	if val, _ := man.Get(req, "ver"); val != "other" {
+		t.Fatalf("unexpected value %v", val)
+	}
+}
+
+func TestDump(t *testing.T) {
+	store := NewMemoryStore()
+	man := NewWithOptions(store)
+	ids := map[string]string{}
+	for _, name := range []string{"a", "b", "c"} {
+		_, req, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		man.Set(req, "name", name)
+		id, _ := SessionIDFromContext(req.Context())
+		ids[id] = name
+	}
+	dump, err := man.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dump) != len(ids) {
+		t.Fatalf("expected %d sessions, got %d", len(ids), len(dump))
+	}
+	for id, name := range ids {
+		if ses := dump[id]; ses == nil || ses.Data["name"] != name {
+			t.Fatalf("session %s missing or has wrong data", name)
+		}
+		dump[id].Data["name"] = "changed"
+	}
+	for id, name := range ids {
+		if ses, _ := store.Read(id); ses.Data["name"] != name {
+			t.Fatal("dump should hold copies")
+		}
+	}
+	if _, err = NewWithOptions(&faultStore{Store: NewMemoryStore()}).Dump(); err != ErrStoreUnsupported {
+		t.Fatal("store without Lister should return ErrStoreUnsupported")
+	}
+}
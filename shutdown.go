@@ -0,0 +1,46 @@
+// Copyright (c), Ruslan Sendecky. All rights reserved
+// Use of this source code is governed by the MIT license
+// See the LICENSE file in the project root for more information
+
+package gsession
+
+import "context"
+
+// Shutdown flushes pending activity writes and stops background workers
+// The store is left open for its owner to close, call after the server stopped serving requests
+// Returns context error if the deadline passes before the work completes
+func (m *Manager) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		m.halt.Do(m.shutdown)
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Closes write queues, drains them and stops the expiry loop
+func (m *Manager) shutdown() {
+	m.wmu.Lock()
+	m.tmu.Lock()
+	m.closed = true
+	m.tmu.Unlock()
+	if m.writes != nil {
+		close(m.writes)
+	}
+	m.wmu.Unlock()
+	if m.writes != nil {
+		<-m.drained
+	}
+	if m.touches != nil {
+		close(m.touches.done)
+		m.flush()
+	}
+	if m.sweeper != nil {
+		m.sweeper <- true
+	}
+}
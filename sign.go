@@ -0,0 +1,73 @@
+// Copyright (c), Ruslan Sendecky. All rights reserved
+// Use of this source code is governed by the MIT license
+// See the LICENSE file in the project root for more information
+
+package gsession
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sign returns cookie value for session ID
+// With signing key set the value is "id.issued.mac", issued being unix seconds
+// Always signed with the current key
+func (m *Manager) sign(id string) string {
+	if len(m.signKeys) == 0 || id == "" {
+		return id
+	}
+	pay := id + "." + strconv.FormatInt(m.now().Unix(), 10)
+	return pay + "." + mac(m.signKeys[0], pay)
+}
+
+// Unsign verifies cookie value and returns session ID and cookie issue time
+// Reports whether the value was signed with a previous key and needs re-signing
+// Issue time is zero when signing is disabled
+func (m *Manager) unsign(val string) (string, time.Time, bool, bool) {
+	if len(m.signKeys) == 0 {
+		return val, time.Time{}, false, m.ids.Valid(val)
+	}
+	i := strings.LastIndexByte(val, '.')
+	if i < 0 {
+		return "", time.Time{}, false, false
+	}
+	key := -1
+	for k, sk := range m.signKeys {
+		if hmac.Equal([]byte(val[i+1:]), []byte(mac(sk, val[:i]))) {
+			key = k
+			break
+		}
+	}
+	if key < 0 {
+		return "", time.Time{}, false, false
+	}
+	id, iss, ok := strings.Cut(val[:i], ".")
+	if !ok || !m.ids.Valid(id) {
+		return "", time.Time{}, false, false
+	}
+	sec, err := strconv.ParseInt(iss, 10, 64)
+	if err != nil {
+		return "", time.Time{}, false, false
+	}
+	return id, time.Unix(sec, 0), key > 0, true
+}
+
+// Mac returns base64 encoded HMAC-SHA256 of payload
+func mac(key []byte, pay string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(pay))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Lapsed reports whether cookie issue time is past absolute expiry
+// Sessions are never older than their cookie so this never rejects a live session
+func (m *Manager) lapsed(iss time.Time) bool {
+	if iss.IsZero() || m.expiry <= 0 {
+		return false
+	}
+	return m.now().After(iss.Add(m.expiry + m.grace))
+}
@@ -0,0 +1,40 @@
+// Copyright (c), Ruslan Sendecky. All rights reserved
+// Use of this source code is governed by the MIT license
+// See the LICENSE file in the project root for more information
+
+package gsession
+
+import "sync/atomic"
+
+// ManagerStats holds cumulative session validation outcome counts
+type ManagerStats struct {
+	Created   uint64
+	Validated uint64
+	Expired   uint64
+	Idled     uint64
+	Renewed   uint64
+	Invalid   uint64
+}
+
+// Validation outcome counters
+type counters struct {
+	created   atomic.Uint64
+	validated atomic.Uint64
+	expired   atomic.Uint64
+	idled     atomic.Uint64
+	renewed   atomic.Uint64
+	invalid   atomic.Uint64
+}
+
+// Stats returns snapshot of validation outcome counts since manager creation
+// Counters are read individually so the snapshot is not atomic as a whole
+func (m *Manager) Stats() ManagerStats {
+	return ManagerStats{
+		Created:   m.stats.created.Load(),
+		Validated: m.stats.validated.Load(),
+		Expired:   m.stats.expired.Load(),
+		Idled:     m.stats.idled.Load(),
+		Renewed:   m.stats.renewed.Load(),
+		Invalid:   m.stats.invalid.Load(),
+	}
+}
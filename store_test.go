@@ -5,13 +5,21 @@
 package gsession
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/dgraph-io/badger/v4"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
 )
 
 func TestStore(t *testing.T) {
@@ -43,6 +51,39 @@ func TestStore(t *testing.T) {
 		return nil
 	}
 
+	testExpireFunc := func(store interface {
+		Store
+		ExpireFunc(time.Duration, func(string, *Session)) error
+	}) error {
+		old := uuid.New().String()
+		cur := uuid.New().String()
+		for _, id := range []string{old, cur} {
+			if err := store.Create(id, nil); err != nil {
+				return err
+			}
+		}
+		err := store.Update(old, func(ses *Session) {
+			ses.Origin = time.Now().AddDate(0, 0, -3)
+		})
+		if err != nil {
+			return err
+		}
+		var ids []string
+		err = store.ExpireFunc(time.Hour*24, func(id string, ses *Session) {
+			ids = append(ids, id)
+		})
+		if err != nil {
+			return err
+		}
+		if len(ids) != 1 || ids[0] != old {
+			return errors.Errorf("callback should fire for expired record only, got %v", ids)
+		}
+		if _, err = store.Read(cur); err != nil {
+			return err
+		}
+		return nil
+	}
+
 	testStore := func(store Store) error {
 		id := uuid.New().String()
 		key := uuid.New().String()
@@ -132,6 +173,10 @@ func TestStore(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		err = testExpireFunc(NewMemoryStore())
+		if err != nil {
+			t.Fatal(err)
+		}
 	})
 	t.Run("file store", func(t *testing.T) {
 		fs = NewFileStore("")
@@ -148,6 +193,706 @@ func TestStore(t *testing.T) {
 			t.Fatal(err)
 		}
 		os.RemoveAll("session")
+		err = testExpireFunc(NewFileStore(filepath.Join(t.TempDir(), "session")))
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("bolt store", func(t *testing.T) {
+		bs, err := NewBoltStore(filepath.Join(t.TempDir(), "session.db"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = runBatch(bs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = testExpiry(bs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = testExpireFunc(bs)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+}
+
+func TestMemoryStoreUpdate(t *testing.T) {
+	store := NewMemoryStore()
+	id := uuid.New().String()
+	err := store.Create(id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs := 0
+	err = store.Update(id, func(ses *Session) {
+		runs++
+		if runs == 1 {
+			// Re-entrant concurrent modification must not deadlock
+			err := store.Update(id, func(ses *Session) {
+				ses.Data["inner"] = "inner"
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		ses.Data["outer"] = "outer"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runs != 2 {
+		t.Fatal("conflicting update should be retried")
+	}
+	ses, err := store.Read(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ses.Data["inner"] != "inner" || ses.Data["outer"] != "outer" {
+		t.Fatal("both updates should be committed")
+	}
+}
+
+func BenchmarkMemoryStoreUpdate(b *testing.B) {
+	store := NewMemoryStore()
+	ids := make([]string, 64)
+	for i := range ids {
+		ids[i] = uuid.New().String()
+		if err := store.Create(ids[i], nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	var seq uint32
+	b.RunParallel(func(pb *testing.PB) {
+		id := ids[atomic.AddUint32(&seq, 1)%uint32(len(ids))]
+		for pb.Next() {
+			err := store.Update(id, func(ses *Session) {
+				ses.Tstamp = time.Now()
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
 	})
+}
+
+func TestMigrate(t *testing.T) {
+	src := NewMemoryStore()
+	bs, err := NewBoltStore(filepath.Join(t.TempDir(), "session.db"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 10)
+	for i := range ids {
+		ids[i] = uuid.New().String()
+		err = src.Create(ids[i], &Session{
+			Origin: time.Now().Add(-time.Hour),
+			Token:  ids[i],
+			Data:   map[string]interface{}{"key": ids[i]},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Pre existing record is kept without overwrite
+	err = bs.Create(ids[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dst := range []Store{NewMemoryStore(), bs} {
+		err = Migrate(dst, src, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range ids {
+			ses, err := dst.Read(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dst == bs && id == ids[0] {
+				if ses.Token != "" {
+					t.Fatal("existing record should not be overwritten")
+				}
+				continue
+			}
+			org, _ := src.Read(id)
+			if ses.Token != id || ses.Data["key"] != id || !ses.Origin.Equal(org.Origin) {
+				t.Fatal("record should be transferred intact")
+			}
+		}
+	}
+	err = Migrate(bs, src, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ses, _ := bs.Read(ids[0]); ses.Token != ids[0] {
+		t.Fatal("existing record should be overwritten")
+	}
+	if err = Migrate(bs, struct{ Store }{src}, true); err != ErrStoreUnsupported {
+		t.Fatal("source without List should return ErrStoreUnsupported")
+	}
+}
+
+func TestFileStoreEnv(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "env")
+	t.Setenv("GSESSION_DIR", dir)
+	fs := NewFileStore("")
+	defer fs.shelf.Close()
+	if _, err := os.Stat(filepath.Join(dir, "MANIFEST")); err != nil {
+		t.Fatal("database should be created in GSESSION_DIR")
+	}
+	arg := filepath.Join(t.TempDir(), "arg")
+	fa := NewFileStore(arg)
+	defer fa.shelf.Close()
+	if _, err := os.Stat(filepath.Join(arg, "MANIFEST")); err != nil {
+		t.Fatal("explicit directory should override GSESSION_DIR")
+	}
+}
+
+func TestFileStoreVacuum(t *testing.T) {
+	fs := NewFileStore(filepath.Join(t.TempDir(), "session"))
+	defer fs.shelf.Close()
+	for i := 0; i < 100; i++ {
+		err := fs.Create(uuid.New().String(), &Session{Origin: time.Now().AddDate(0, 0, -3)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	erc := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := fs.Expire(time.Hour * 24); err != nil {
+				erc <- err
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			fs.collect()
+		}()
+	}
+	wg.Wait()
+	close(erc)
+	for err := range erc {
+		t.Fatal(err)
+	}
+	if num, _ := fs.Count(); num != 0 {
+		t.Fatal("expired records should be removed")
+	}
+}
+
+func TestFileStoreLogger(t *testing.T) {
+	var mu sync.Mutex
+	var lines []string
+	logger := func(level, msg string, kv ...interface{}) {
+		mu.Lock()
+		lines = append(lines, level+": "+msg)
+		mu.Unlock()
+	}
+	fs := NewFileStore(filepath.Join(t.TempDir(), "session"), StoreLogger(logger))
+	defer fs.shelf.Close()
+	fs.collect()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(lines) == 0 || lines[len(lines)-1] != "debug: value log gc cycle" {
+		t.Fatalf("gc cycle should be logged, got %q", lines)
+	}
+}
+
+func TestFileStoreCodec(t *testing.T) {
+	fs := NewFileStore(filepath.Join(t.TempDir(), "session"), StoreCodec(JSONCodec{}))
+	defer fs.shelf.Close()
+	ses := &Session{Data: map[string]interface{}{"name": "val", "num": 42}}
+	if err := fs.Create("id", ses); err != nil {
+		t.Fatal(err)
+	}
+	err := fs.shelf.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("id"))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if !json.Valid(val) {
+				t.Fatal("record should be JSON encoded")
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Update("id", func(ses *Session) {
+		ses.Data["num"] = ses.Data["num"].(int) + 1
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := fs.Read("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Data["name"] != "val" || res.Data["num"] != 43 {
+		t.Fatalf("unexpected data %v", res.Data)
+	}
+}
+
+func TestFileStorePrefix(t *testing.T) {
+	fs := NewFileStore(filepath.Join(t.TempDir(), "session"), StorePrefix("ses:"))
+	defer fs.shelf.Close()
+	err := fs.shelf.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("app:config"), []byte("not a session"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := &Session{Origin: time.Now().Add(-time.Hour * 2), Tstamp: time.Now()}
+	if err = fs.Create("old", old); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Create("new", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Read("new"); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := fs.List(); len(ids) != 2 {
+		t.Fatalf("only prefixed keys should be listed, got %v", ids)
+	}
+	if err = fs.Expire(time.Hour); err != nil {
+		t.Fatal("expire should skip unrelated keys")
+	}
+	if num, _ := fs.Count(); num != 1 {
+		t.Fatal("expired session should be removed")
+	}
+	err = fs.shelf.View(func(txn *badger.Txn) error {
+		if _, err := txn.Get([]byte("app:config")); err != nil {
+			return err
+		}
+		_, err := txn.Get([]byte("ses:new"))
+		return err
+	})
+	if err != nil {
+		t.Fatal("unrelated key should be left untouched and sessions stored under prefix")
+	}
+}
+
+func TestFileStoreSweepJunk(t *testing.T) {
+	fs := NewFileStore(filepath.Join(t.TempDir(), "session"), StorePrefix("ses:"))
+	defer fs.shelf.Close()
+	err := fs.shelf.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("ses:junk"), []byte("not a session"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := &Session{Origin: time.Now().Add(-time.Hour * 2), Tstamp: time.Now()}
+	if err = fs.Create("old", old); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Expire(time.Hour); err != nil {
+		t.Fatalf("undecodable record should be skipped, got %v", err)
+	}
+	if _, err = fs.Read("old"); err != ErrSessionNoRecord {
+		t.Fatal("expired session should be removed past the undecodable record")
+	}
+	if num, _ := fs.Count(); num != 1 {
+		t.Fatal("undecodable record should be left in place")
+	}
+}
 
+func TestBoltStoreSweepJunk(t *testing.T) {
+	var logged int
+	bs, err := NewBoltStore(filepath.Join(t.TempDir(), "session.db"), "", StoreLogger(func(level, msg string, kv ...interface{}) {
+		logged++
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.shelf.Close()
+	err = bs.shelf.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bs.bucket).Put([]byte("junk"), []byte("not a session"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := &Session{Origin: time.Now().Add(-time.Hour * 2), Tstamp: time.Now()}
+	if err = bs.Create("old", old); err != nil {
+		t.Fatal(err)
+	}
+	if err = bs.Expire(time.Hour); err != nil {
+		t.Fatalf("undecodable record should be skipped, got %v", err)
+	}
+	if _, err = bs.Read("old"); err != ErrSessionNoRecord {
+		t.Fatal("expired session should be removed past the undecodable record")
+	}
+	if num, _ := bs.Count(); num != 1 {
+		t.Fatal("undecodable record should be left in place")
+	}
+	if logged == 0 {
+		t.Fatal("undecodable record should be logged")
+	}
+}
+
+func TestSessionJSONNames(t *testing.T) {
+	bts, err := JSONCodec{}.Encode(&Session{Token: "tok", Data: map[string]interface{}{"key": "val"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(bts, &raw); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"origin", "tstamp", "token", "data"} {
+		if _, ok := raw[name]; !ok {
+			t.Fatalf("field %s missing in %s", name, bts)
+		}
+	}
+	if _, ok := raw["Token"]; ok {
+		t.Fatal("capitalized field names should not be used")
+	}
+	// Records written before the tags still decode
+	ses := new(Session)
+	if err := (JSONCodec{}).Decode([]byte(`{"Token":"tok","Data":{"key":"val"}}`), ses); err != nil {
+		t.Fatal(err)
+	}
+	if ses.Token != "tok" || ses.Data["key"] != "val" {
+		t.Fatal("legacy field names should decode")
+	}
+}
+
+func TestGobCodecVersion(t *testing.T) {
+	ses := &Session{Token: "tok"}
+	bts, err := GobCodec{}.Encode(ses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bts[0] != gobVersion {
+		t.Fatal("record should start with version byte")
+	}
+	res := new(Session)
+	if err = (GobCodec{}).Decode(bts, res); err != nil || res.Token != "tok" {
+		t.Fatal("versioned record should decode")
+	}
+	legacy, _ := encGob(ses)
+	res = new(Session)
+	if err = (GobCodec{}).Decode(legacy, res); err != nil || res.Token != "tok" {
+		t.Fatal("unversioned record should decode")
+	}
+	bts[0] = gobVersion + 1
+	if err = (GobCodec{}).Decode(bts, new(Session)); err != ErrCodecVersion {
+		t.Fatalf("expected ErrCodecVersion, got %v", err)
+	}
+}
+
+func TestEmptyID(t *testing.T) {
+	dir := t.TempDir()
+	fs := NewFileStore(filepath.Join(dir, "session"))
+	defer fs.shelf.Close()
+	bs, err := NewBoltStore(filepath.Join(dir, "session.db"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.shelf.Close()
+	stores := map[string]Store{"memory": NewMemoryStore(), "file": fs, "bolt": bs, "null": NewNullStore(nil)}
+	for name, st := range stores {
+		if err := st.Create("", nil); err != ErrEmptyID {
+			t.Fatalf("%s: create should return ErrEmptyID, got %v", name, err)
+		}
+		if _, err := st.Read(""); err != ErrEmptyID {
+			t.Fatalf("%s: read should return ErrEmptyID, got %v", name, err)
+		}
+		if err := st.Update("", func(*Session) {}); err != ErrEmptyID {
+			t.Fatalf("%s: update should return ErrEmptyID, got %v", name, err)
+		}
+		if err := st.Delete(""); err != ErrEmptyID {
+			t.Fatalf("%s: delete should return ErrEmptyID, got %v", name, err)
+		}
+	}
+}
+
+func TestDeleteMissing(t *testing.T) {
+	dir := t.TempDir()
+	fs := NewFileStore(filepath.Join(dir, "session"))
+	defer fs.shelf.Close()
+	bs, err := NewBoltStore(filepath.Join(dir, "session.db"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.shelf.Close()
+	stores := map[string]Store{"memory": NewMemoryStore(), "file": fs, "bolt": bs}
+	for name, st := range stores {
+		if err := st.Delete("missing"); err != nil {
+			t.Fatalf("%s: deleting missing record should succeed, got %v", name, err)
+		}
+	}
+}
+
+func TestMemoryStoreStats(t *testing.T) {
+	ms := NewMemoryStore()
+	if num, size := ms.Stats(); num != 0 || size != 0 {
+		t.Fatal("empty store should report zero")
+	}
+	for i := 0; i < 10; i++ {
+		ms.Create(fmt.Sprint(i), nil)
+	}
+	num, size := ms.Stats()
+	if num != 10 || size <= 0 {
+		t.Fatalf("unexpected stats %d %d", num, size)
+	}
+	ms.Update("0", func(ses *Session) {
+		ses.Data["blob"] = strings.Repeat("x", 4096)
+	})
+	if _, grown := ms.Stats(); grown < size+4096 {
+		t.Fatal("size estimate should grow with stored data")
+	}
+}
+
+func TestMemoryStoreLRU(t *testing.T) {
+	ms := NewMemoryStoreLRU(3)
+	for _, id := range []string{"a", "b", "c"} {
+		if err := ms.Create(id, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Touch "a" so "b" becomes the least recently used
+	if _, err := ms.Read("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Create("d", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.Read("b"); err != ErrSessionNoRecord {
+		t.Fatal("least recently used session should be evicted")
+	}
+	if err := ms.Update("c", func(*Session) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Create("e", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.Read("a"); err != ErrSessionNoRecord {
+		t.Fatal("oldest session should be evicted")
+	}
+	for _, id := range []string{"c", "d", "e"} {
+		if _, err := ms.Read(id); err != nil {
+			t.Fatalf("session %s should be kept", id)
+		}
+	}
+	if err := ms.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	if num, _ := ms.Count(); num != 2 || ms.lru.order.Len() != 2 {
+		t.Fatal("deleted session should leave access order")
+	}
+}
+
+func TestFailoverPassThrough(t *testing.T) {
+	fs := NewFailoverStore(NewMemoryStore())
+	if err := fs.Create("", nil); err != ErrEmptyID {
+		t.Fatalf("expected ErrEmptyID, got %v", err)
+	}
+	if err := fs.Update("missing", func(*Session) {}); err != ErrSessionNoRecord {
+		t.Fatalf("expected ErrSessionNoRecord, got %v", err)
+	}
+	if fs.Degraded() {
+		t.Fatal("invalid ID and missing record should not degrade")
+	}
+
+	file := NewFileStore(filepath.Join(t.TempDir(), "session"))
+	defer file.shelf.Close()
+	err := file.shelf.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("junk"), []byte("not a session"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs = NewFailoverStore(file)
+	var cerr *CodecError
+	if err = fs.Update("junk", func(*Session) {}); !errors.As(err, &cerr) {
+		t.Fatalf("expected codec error, got %v", err)
+	}
+	if fs.Degraded() {
+		t.Fatal("undecodable record should not degrade")
+	}
+}
+
+func TestFailoverStore(t *testing.T) {
+	var logged int
+	logger := func(level, msg string, kv ...interface{}) {
+		if level == "error" {
+			logged++
+		}
+	}
+	primary := &faultStore{Store: NewMemoryStore()}
+	fs := NewFailoverStore(primary, StoreLogger(logger))
+	old := &Session{Data: map[string]interface{}{"key": "old"}}
+	if err := fs.Create("old", old); err != nil {
+		t.Fatal(err)
+	}
+	if fs.Degraded() {
+		t.Fatal("store should not degrade while primary works")
+	}
+
+	// Primary becomes read only
+	primary.create = errors.New("read only")
+	primary.update = primary.create
+	primary.delete = primary.create
+	if err := fs.Create("new", nil); err != nil {
+		t.Fatal(err)
+	}
+	if !fs.Degraded() || logged != 1 {
+		t.Fatal("write failure should degrade to memory with a warning")
+	}
+	if _, err := fs.Read("new"); err != nil {
+		t.Fatal("record should be read from fallback")
+	}
+	err := fs.Update("old", func(ses *Session) { ses.Data["key"] = "upd" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	ses, err := fs.Read("old")
+	if err != nil || ses.Data["key"] != "upd" {
+		t.Fatal("primary record should be updated in fallback")
+	}
+	if err = fs.Update("none", func(*Session) {}); err != ErrSessionNoRecord {
+		t.Fatal("missing record should return ErrSessionNoRecord")
+	}
+	if err = fs.Delete("old"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Read("old"); err != ErrSessionNoRecord {
+		t.Fatal("deleted record should not be read back from primary")
+	}
+
+	man := New(fs, 0, 0, 0)
+	_, req, err := man.Register(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = man.Set(req, "key", "val"); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := man.Get(req, "key"); err != nil || val != "val" {
+		t.Fatal("manager should work on degraded store")
+	}
+}
+
+func TestCacheStore(t *testing.T) {
+	cache := NewMemoryStore()
+	backend := NewFileStore(filepath.Join(t.TempDir(), "session"))
+	defer backend.shelf.Close()
+	cs := NewCacheStore(cache, backend)
+
+	// Record written to the backend only is read through and cached
+	err := backend.Create("id", &Session{Data: map[string]interface{}{"key": "val"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ses, err := cs.Read("id")
+	if err != nil || ses.Data["key"] != "val" {
+		t.Fatal("backend record should be read through")
+	}
+	if _, err = cache.Read("id"); err != nil {
+		t.Fatal("read should populate cache")
+	}
+
+	err = cs.Update("id", func(ses *Session) { ses.Data["key"] = "upd" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range []Store{cache, backend} {
+		if ses, err = st.Read("id"); err != nil || ses.Data["key"] != "upd" {
+			t.Fatalf("%T should hold updated record", st)
+		}
+	}
+
+	if err = cs.Delete("id"); err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range []Store{cs, cache, backend} {
+		if _, err = st.Read("id"); err != ErrSessionNoRecord {
+			t.Fatalf("%T should not hold deleted record", st)
+		}
+	}
+	if err = cs.Update("id", func(*Session) {}); err != ErrSessionNoRecord {
+		t.Fatal("update of deleted record should return ErrSessionNoRecord")
+	}
+	if _, err = cache.Read("id"); err != ErrSessionNoRecord {
+		t.Fatal("failed update should not repopulate cache")
+	}
+
+	// Record deleted while its backend update completes is not cached again
+	hook := &hookStore{Store: backend}
+	cs = NewCacheStore(cache, hook)
+	if err = cs.Create("id", nil); err != nil {
+		t.Fatal(err)
+	}
+	hook.after = func() { cs.Delete("id") }
+	if err = cs.Update("id", func(*Session) {}); err != nil {
+		t.Fatal(err)
+	}
+	hook.after = nil
+	if _, err = cs.Read("id"); err != ErrSessionNoRecord {
+		t.Fatal("deleted record should not be resurrected in cache")
+	}
+}
+
+// Store running a function after each update
+type hookStore struct {
+	Store
+	after func()
+}
+
+func (s *hookStore) Update(id string, fn func(*Session)) error {
+	err := s.Store.Update(id, fn)
+	if s.after != nil {
+		s.after()
+	}
+	return err
+}
+
+func TestExpireIdle(t *testing.T) {
+	dir := t.TempDir()
+	fs := NewFileStore(filepath.Join(dir, "session"))
+	defer fs.shelf.Close()
+	bs, err := NewBoltStore(filepath.Join(dir, "session.db"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.shelf.Close()
+	stores := map[string]Store{"memory": NewMemoryStore(), "file": fs, "bolt": bs}
+	for name, st := range stores {
+		now := time.Now()
+		recs := map[string]*Session{
+			"active": {Origin: now.Add(-time.Hour * 2), Tstamp: now},
+			"idle":   {Origin: now.Add(-time.Hour * 2), Tstamp: now.Add(-time.Hour * 2)},
+			"own":    {Origin: now.Add(-time.Hour * 2), Tstamp: now.Add(-time.Hour * 2), Idle: -1},
+		}
+		for id, ses := range recs {
+			if err := st.Create(id, ses); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := st.Expire(time.Hour * 24); err != nil {
+			t.Fatal(err)
+		}
+		if num, _ := st.(Counter).Count(); num != 3 {
+			t.Fatalf("%s: expire should keep idle but not expired records", name)
+		}
+		if err := st.(IdleExpirer).ExpireIdle(time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := st.Read("idle"); err != ErrSessionNoRecord {
+			t.Fatalf("%s: idle record should be removed", name)
+		}
+		for _, id := range []string{"active", "own"} {
+			if _, err := st.Read(id); err != nil {
+				t.Fatalf("%s: %s record should be kept", name, id)
+			}
+		}
+	}
 }
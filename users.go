@@ -0,0 +1,77 @@
+// Copyright (c), Ruslan Sendecky. All rights reserved
+// Use of this source code is governed by the MIT license
+// See the LICENSE file in the project root for more information
+
+package gsession
+
+import "context"
+
+// SessionsForUser returns IDs of sessions owned by the user
+// Uses store user index when available, otherwise scans stores implementing Lister
+// Other stores return ErrStoreUnsupported. Empty user ID matches no sessions
+// Takes user ID
+func (m *Manager) SessionsForUser(uid string) ([]string, error) {
+	if m.store == nil {
+		return nil, ErrStoreUnavailable
+	}
+	if uid == "" {
+		return nil, nil
+	}
+	if ul, ok := m.store.(UserLister); ok {
+		keys, err := ul.ListUser(uid)
+		if err != nil {
+			return nil, err
+		}
+		ids := make([]string, 0, len(keys))
+		for _, key := range keys {
+			if id, ok := m.unkey(key); ok {
+				ids = append(ids, id)
+			}
+		}
+		return ids, nil
+	}
+	lst, ok := m.store.(Lister)
+	if !ok {
+		return nil, ErrStoreUnsupported
+	}
+	keys, err := lst.List()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, key := range keys {
+		id, ok := m.unkey(key)
+		if !ok {
+			continue
+		}
+		ses, err := m.read(context.Background(), id)
+		if err != nil {
+			if err == ErrSessionNoRecord {
+				continue
+			}
+			return nil, err
+		}
+		if ses.User == uid {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// InvalidateUser deletes every session owned by the user
+// Owners of deleted sessions get a new empty session on their next request
+// Takes user ID
+func (m *Manager) InvalidateUser(uid string) error {
+	ids, err := m.SessionsForUser(uid)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err = m.remove(context.Background(), id)
+		if err != nil {
+			return err
+		}
+	}
+	m.log("info", "user sessions invalidated", "count", len(ids))
+	return nil
+}